@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/imrenagi/satpol-pp/server"
+	"github.com/imrenagi/satpol-pp/server/manifest"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/imrenagi/satpol-pp/server/report"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NewCheckCmd returns a new `check` command which checks manifests against a
+// policy file without a cluster
+func NewCheckCmd() *cobra.Command {
+	var (
+		policyFile  string
+		namespace   string
+		output      string
+		hashKeyFile string
+	)
+
+	checkCmd := cobra.Command{
+		Use:   "check [flags] PATH...",
+		Short: "check manifests against a policy file",
+		Long: `Check the objects of YAML or JSON manifests against a policy file, the same
+way the webhook would when they are applied. PATH is a file, a directory or -
+for stdin. The command fails when any object is denied.
+
+The results can be written as text, JSON, SARIF 2.1.0 (e.g. for GitHub code
+scanning) or JUnit XML (e.g. for Jenkins test reports).`,
+		Args:         cobra.MinimumNArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if policyFile == "" {
+				return fmt.Errorf("policy file must be set with --policy-file")
+			}
+			pol, err := policy.Load(policyFile)
+			if err != nil {
+				return err
+			}
+			if hashKeyFile != "" {
+				if err := loadHashKey(hashKeyFile); err != nil {
+					return err
+				}
+			}
+
+			objects, err := manifest.ReadPaths(args, cmd.InOrStdin())
+			if err != nil {
+				return err
+			}
+
+			// agents log through the global logger, whose debug output would
+			// print the scanned configmaps
+			zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+			logger := zerolog.New(zerolog.ConsoleWriter{Out: cmd.ErrOrStderr()}).With().Timestamp().Logger()
+			handler, err := server.NewHandler(nil, policy.NewStore(pol), logger)
+			if err != nil {
+				return err
+			}
+			defer handler.Close()
+
+			results := make([]report.Result, 0, len(objects))
+			denied := 0
+			for _, obj := range objects {
+				req := admissionRequest(obj, namespace)
+				resp, eval := handler.Review(context.Background(), req)
+				if !resp.Allowed {
+					denied++
+				}
+				results = append(results, result(obj, req, resp, eval))
+			}
+
+			if err := report.Write(cmd.OutOrStdout(), output, results); err != nil {
+				return err
+			}
+			if denied > 0 {
+				return fmt.Errorf("%d of %d object(s) denied", denied, len(objects))
+			}
+			return nil
+		},
+	}
+
+	checkCmd.Flags().StringVar(&policyFile, "policy-file", os.Getenv("SATPOLPP_POLICY_FILE"), "path to the yaml policy file")
+	checkCmd.Flags().StringVarP(&output, "output", "o", report.FormatText, fmt.Sprintf("output format, one of %s", strings.Join(report.Formats, ", ")))
+	checkCmd.Flags().StringVar(&hashKeyFile, "hash-key-file", os.Getenv("SATPOLPP_HASH_KEY_FILE"), "path to the secret key of the webhook, so that findings get the same hashes")
+	checkCmd.Flags().StringVarP(&namespace, "namespace", "n", metav1.NamespaceDefault, "namespace of the objects which do not set one")
+
+	return &checkCmd
+}
+
+// admissionRequest builds the request the API server would send when the
+// object is created
+func admissionRequest(obj manifest.Object, namespace string) *admissionv1.AdmissionRequest {
+	gvk := obj.GroupVersionKind()
+	if ns := obj.GetNamespace(); ns != "" {
+		namespace = ns
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:       types.UID(fmt.Sprintf("%s/%s", obj.Source, obj.GetName())),
+		Kind:      metav1.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind},
+		Name:      obj.GetName(),
+		Namespace: namespace,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: obj.Raw},
+	}
+}
+
+// result converts the response of the webhook into a report result, adding
+// the location of each violation in the manifest
+func result(obj manifest.Object, req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *server.Evaluation) report.Result {
+	r := report.Result{
+		Source:     obj.Source,
+		Index:      obj.Index,
+		Line:       obj.Line(""),
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  req.Namespace,
+		Name:       obj.GetName(),
+		Allowed:    resp.Allowed,
+		Warnings:   resp.Warnings,
+	}
+	if !resp.Allowed && resp.Result != nil {
+		r.Message = resp.Result.Message
+	}
+	if eval == nil {
+		return r
+	}
+	for _, d := range eval.Decisions {
+		r.Violations = append(r.Violations, report.Violation{
+			RuleID:  d.RuleID,
+			Action:  d.Action,
+			Field:   d.Field,
+			Message: d.Message,
+			Line:    obj.Line(d.Field),
+		})
+	}
+	return r
+}
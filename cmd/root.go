@@ -31,6 +31,7 @@ func NewRootCommand(args []string) *cobra.Command {
 	command.AddCommand(
 		NewVersionCmd(),
 		NewServerCmd(),
+		NewCheckCmd(),
 	)
 
 	flags.ParseErrorsWhitelist.UnknownFlags = true
@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -15,22 +19,45 @@ import (
 	"os/signal"
 	"syscall"
 
-	"github.com/hashicorp/vault-k8s/helper/cert"
 	"github.com/imrenagi/satpol-pp/server"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/cert"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/imrenagi/satpol-pp/server/redact"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	autoName     string
-	autoHosts    string
-	certFilePath string
-	keyFilePath  string
-	certStorage  atomic.Value
+	autoName       string
+	autoHosts      string
+	certFilePath   string
+	keyFilePath    string
+	policyFilePath string
+	watchPolicies  bool
+	policyReports  bool
+	auditInterval  time.Duration
+	auditRate      float64
+	movedSecrets   time.Duration
+	metricsAddr    string
+	recordEvents   bool
+	hashKeyFile    string
+	certStorage    atomic.Value
+)
+
+const (
+	policyPollInterval = 5 * time.Second
+	policyResyncPeriod = 10 * time.Minute
+	policyReportPeriod = 10 * time.Second
 )
 
 // NewServerCmd returns a new `version` command to be used as a sub-command to root
@@ -44,8 +71,24 @@ func NewServerCmd() *cobra.Command {
 			ctx, cancelFunc := context.WithCancel(context.Background())
 			defer cancelFunc()
 
+			if policyFilePath == "" {
+				log.Fatal().Msg("policy file must be set with --policy-file")
+			}
+			// deleted objects only leave the reports when the audit scans
+			if policyReports && auditInterval <= 0 {
+				log.Fatal().Msg("--policy-reports requires the audit, see --audit-interval")
+			}
+			pol, err := policy.Load(policyFilePath)
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to load policy")
+			}
+			if hashKeyFile == "" {
+				log.Warn().Msg("no --hash-key-file is set, so the hashes of findings change on every restart and cannot be allowed")
+			} else if err := loadHashKey(hashKeyFile); err != nil {
+				log.Fatal().Err(err).Msg("unable to load hash key")
+			}
+
 			var config *rest.Config
-			var err error
 
 			if os.Getenv("ENV") == "development" {
 				kubeconfig := filepath.Join(homeDir(), ".kube", "config")
@@ -83,26 +126,75 @@ func NewServerCmd() *cobra.Command {
 			go certNotify.Run()
 			go certWatcher(ctx, certCh, clientset)
 
-			handler := server.Handler{
-				Clientset: clientset,
-				Log:       log.With().Timestamp().Logger(),
+			policies := policy.NewStore(pol)
+			policyWatcher := policy.NewWatcher(policyFilePath, policyPollInterval, policies.SetBase)
+			go policyWatcher.Run(ctx)
+
+			dynamicClient, err := dynamic.NewForConfig(config)
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to create dynamic client")
+			}
+
+			if watchPolicies {
+				policyInformer := policy.NewInformer(dynamicClient, policies, policyResyncPeriod)
+				go policyInformer.Run(ctx)
+			}
+
+			handler, err := server.NewHandler(clientset, policies, log.With().Timestamp().Logger())
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to create handler")
+			}
+			defer handler.Close()
+
+			if recordEvents {
+				recorder := server.NewEventRecorder(clientset, log.With().Timestamp().Logger())
+				defer recorder.Shutdown()
+				handler.OnReview(recorder.Record)
+			}
+
+			var reporter *server.PolicyReporter
+			if policyReports {
+				reporter = server.NewPolicyReporter(dynamicClient, policyReportPeriod, log.With().Timestamp().Logger())
+				handler.OnReview(reporter.Record)
+				go reporter.Run(ctx)
+			}
+
+			if auditInterval > 0 {
+				auditor := server.NewAuditor(handler, auditInterval, auditRate)
+				if reporter != nil {
+					auditor.OnScan(reporter.SetAuditResults)
+				}
+				go auditor.Run(ctx)
+			}
+
+			if movedSecrets > 0 {
+				reconciler := server.NewMovedSecretReconciler(clientset, movedSecrets, log.With().Timestamp().Logger())
+				go reconciler.Run(ctx)
 			}
 
 			mux := http.NewServeMux()
 
 			mux.HandleFunc("/", home)
 			mux.HandleFunc("/deployments/check", handler.DeploymentCheckHandler())
+			mux.HandleFunc("/statefulsets/check", handler.WorkloadCheckHandler(dep.KindStatefulSet))
+			mux.HandleFunc("/daemonsets/check", handler.WorkloadCheckHandler(dep.KindDaemonSet))
+			mux.HandleFunc("/replicasets/check", handler.WorkloadCheckHandler(dep.KindReplicaSet))
+			mux.HandleFunc("/jobs/check", handler.WorkloadCheckHandler(dep.KindJob))
+			mux.HandleFunc("/cronjobs/check", handler.WorkloadCheckHandler(dep.KindCronJob))
+			mux.HandleFunc("/pods/check", handler.WorkloadCheckHandler(dep.KindPod))
 			mux.HandleFunc("/configmaps/check", handler.ConfigMapCheckHandler())
+			mux.HandleFunc("/configmaps/mutate", handler.ConfigMapMutateHandler())
 
 			// trusted docker registry
 			// liveness and readiness probe
 			// no secret or sensitive information stored in configmap
 
+			// the checks may take as long as the timeoutSeconds of the webhook
 			s := &http.Server{
 				Addr:         ":8080",
 				Handler:      mux,
 				ReadTimeout:  10 * time.Second,
-				WriteTimeout: 10 * time.Second,
+				WriteTimeout: server.MaxAdmissionTimeout,
 				TLSConfig:    &tls.Config{GetCertificate: getCertificate},
 			}
 
@@ -115,7 +207,31 @@ func NewServerCmd() *cobra.Command {
 				}
 			}()
 
-			termChan := make(chan os.Signal)
+			var metricsServer *http.Server
+			if metricsAddr != "" {
+				prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+					Namespace: "satpolpp",
+					Name:      "certificate_expiry_timestamp_seconds",
+					Help:      "Unix time when the serving certificate expires, 0 when there is none yet.",
+				}, certificateExpiry))
+
+				metricsMux := http.NewServeMux()
+				metricsMux.Handle("/metrics", promhttp.Handler())
+				metricsServer = &http.Server{
+					Addr:         metricsAddr,
+					Handler:      metricsMux,
+					ReadTimeout:  10 * time.Second,
+					WriteTimeout: 10 * time.Second,
+				}
+				go func() {
+					log.Warn().Msgf("serving metrics on %s", metricsServer.Addr)
+					if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						log.Fatal().Err(err).Msg("cant start metrics server")
+					}
+				}()
+			}
+
+			termChan := make(chan os.Signal, 1)
 			signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 			defer func() {
 				signal.Stop(termChan)
@@ -127,6 +243,11 @@ func NewServerCmd() *cobra.Command {
 				if err := s.Shutdown(ctx); err != nil {
 					log.Fatal().Err(err).Msg("error shutting down handler")
 				}
+				if metricsServer != nil {
+					if err := metricsServer.Shutdown(ctx); err != nil {
+						log.Error().Err(err).Msg("error shutting down metrics server")
+					}
+				}
 				cancelFunc()
 			case <-ctx.Done():
 			}
@@ -137,10 +258,58 @@ func NewServerCmd() *cobra.Command {
 	serverCmd.Flags().StringVar(&autoHosts, "auto-hosts", os.Getenv("SATPOLPP_AUTO_HOST"), "all hosts name used for tls cert generation")
 	serverCmd.Flags().StringVar(&certFilePath, "tls-cert", os.Getenv("SATPOLPP_CERT_FILE_PATH"), "tls certificate path")
 	serverCmd.Flags().StringVar(&keyFilePath, "tls-key", os.Getenv("SATPOLPP_KEY_FILE_PATH"), "tls private key path")
+	serverCmd.Flags().StringVar(&policyFilePath, "policy-file", os.Getenv("SATPOLPP_POLICY_FILE"), "path to the yaml policy file")
+	serverCmd.Flags().StringVar(&hashKeyFile, "hash-key-file", os.Getenv("SATPOLPP_HASH_KEY_FILE"), "path to the secret key of the hashes which identify findings")
+	serverCmd.Flags().BoolVar(&watchPolicies, "watch-policies", os.Getenv("SATPOLPP_WATCH_POLICIES") == "true", "also load SatpolPolicy and SatpolNamespacePolicy objects from the cluster")
+
+	serverCmd.Flags().StringVar(&metricsAddr, "metrics-addr", envString("SATPOLPP_METRICS_ADDR", ":9090"), "plain http address serving prometheus metrics on /metrics, empty disables it")
+	serverCmd.Flags().BoolVar(&recordEvents, "record-events", os.Getenv("SATPOLPP_RECORD_EVENTS") != "false", "record a kubernetes event when an object is denied or warned")
+	serverCmd.Flags().BoolVar(&policyReports, "policy-reports", os.Getenv("SATPOLPP_POLICY_REPORTS") == "true", "write the audit and admission results as wgpolicyk8s.io PolicyReports")
+	serverCmd.Flags().DurationVar(&auditInterval, "audit-interval", envDuration("SATPOLPP_AUDIT_INTERVAL"), "how often existing objects are audited, 0 disables the audit")
+	serverCmd.Flags().Float64Var(&auditRate, "audit-inspections-per-second", envFloat("SATPOLPP_AUDIT_INSPECTIONS_PER_SECOND", 1), "maximum workload and configmap inspections per second during an audit, to save DLP quota")
+	serverCmd.Flags().DurationVar(&movedSecrets, "moved-secrets-interval", envDuration("SATPOLPP_MOVED_SECRETS_INTERVAL"), "how often the Secrets of moved secrets are owned by their configmap, or deleted when it does not exist, 0 disables it")
 
 	return &serverCmd
 }
 
+// envString returns the environment variable, or def when it is not set
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envDuration returns the duration in the environment variable, or 0 when it
+// is not set or invalid
+func envDuration(key string) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// envFloat returns the number in the environment variable, or def when it is
+// not set or invalid
+func envFloat(key string, def float64) float64 {
+	f, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// loadHashKey keys the hashes of findings with the content of the file, e.g.
+// mounted from a Secret
+func loadHashKey(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return redact.SetKey(bytes.TrimSpace(b))
+}
+
 func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	certRaw := certStorage.Load()
 	if certRaw == nil {
@@ -149,6 +318,23 @@ func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return certRaw.(*tls.Certificate), nil
 }
 
+// certificateExpiry returns when the serving certificate expires as unix time
+func certificateExpiry() float64 {
+	certRaw := certStorage.Load()
+	if certRaw == nil {
+		return 0
+	}
+	crt := certRaw.(*tls.Certificate)
+	if len(crt.Certificate) == 0 {
+		return 0
+	}
+	leaf, err := x509.ParseCertificate(crt.Certificate[0])
+	if err != nil {
+		return 0
+	}
+	return float64(leaf.NotAfter.Unix())
+}
+
 func certWatcher(ctx context.Context, ch <-chan cert.Bundle, clientset *kubernetes.Clientset) {
 	var bundle cert.Bundle
 	for {
@@ -167,20 +353,7 @@ func certWatcher(ctx context.Context, ch <-chan cert.Bundle, clientset *kubernet
 		}
 
 		if autoHosts != "" && len(bundle.CACert) > 0 {
-			value := base64.StdEncoding.EncodeToString(bundle.CACert)
-			_, err := clientset.AdmissionregistrationV1beta1().
-				ValidatingWebhookConfigurations().
-				Patch(autoName, types.JSONPatchType, []byte(fmt.Sprintf(
-					`[{
-						"op": "add",
-						"path": "/webhooks/0/clientConfig/caBundle",
-						"value": %q
-					},{
-						"op": "add",
-						"path": "/webhooks/1/clientConfig/caBundle",
-						"value": %q
-					}]`, value, value)))
-			if err != nil {
+			if err := patchCABundle(ctx, clientset, bundle.CACert); err != nil {
 				log.Error().Err(err).Msg("Error updating ValidatingWebhookConfiguration")
 				continue
 			}
@@ -189,6 +362,69 @@ func certWatcher(ctx context.Context, ch <-chan cert.Bundle, clientset *kubernet
 	}
 }
 
+// patchCABundle sets the CA bundle of every webhook in the
+// ValidatingWebhookConfiguration, and in the MutatingWebhookConfiguration of
+// the same name when it is installed. The admissionregistration.k8s.io/v1 api
+// is used unless the cluster only serves v1beta1.
+func patchCABundle(ctx context.Context, clientset *kubernetes.Clientset, caCert []byte) error {
+	value := base64.StdEncoding.EncodeToString(caCert)
+	if err := patchMutatingCABundle(ctx, clientset, value); err != nil {
+		return err
+	}
+
+	v1 := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	cfg, err := v1.Get(ctx, autoName, metav1.GetOptions{})
+	if err == nil {
+		_, err = v1.Patch(ctx, autoName, types.JSONPatchType, caBundlePatch(len(cfg.Webhooks), value), metav1.PatchOptions{})
+		return err
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	v1beta1 := clientset.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	cfgv1beta1, err := v1beta1.Get(ctx, autoName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	_, err = v1beta1.Patch(ctx, autoName, types.JSONPatchType, caBundlePatch(len(cfgv1beta1.Webhooks), value), metav1.PatchOptions{})
+	return err
+}
+
+// patchMutatingCABundle sets the CA bundle of the optional
+// MutatingWebhookConfiguration
+func patchMutatingCABundle(ctx context.Context, clientset *kubernetes.Clientset, value string) error {
+	v1 := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	cfg, err := v1.Get(ctx, autoName, metav1.GetOptions{})
+	if err == nil {
+		_, err = v1.Patch(ctx, autoName, types.JSONPatchType, caBundlePatch(len(cfg.Webhooks), value), metav1.PatchOptions{})
+		return err
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	v1beta1 := clientset.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	cfgv1beta1, err := v1beta1.Get(ctx, autoName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = v1beta1.Patch(ctx, autoName, types.JSONPatchType, caBundlePatch(len(cfgv1beta1.Webhooks), value), metav1.PatchOptions{})
+	return err
+}
+
+// caBundlePatch returns a json patch which sets the CA bundle of n webhooks
+func caBundlePatch(n int, caBundle string) []byte {
+	ops := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ops = append(ops, fmt.Sprintf(`{"op": "add", "path": "/webhooks/%d/clientConfig/caBundle", "value": %q}`, i, caBundle))
+	}
+	return []byte("[" + strings.Join(ops, ",") + "]")
+}
+
 func home(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("healthy"))
 }
@@ -4,26 +4,21 @@ go 1.15
 
 require (
 	cloud.google.com/go v0.70.0
-	contrib.go.opencensus.io/exporter/stackdriver v0.13.4 // indirect
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/googleapis/gax-go v1.0.3 // indirect
-	github.com/hashicorp/go-hclog v0.14.1
+	github.com/evanphx/json-patch v4.9.0+incompatible
+	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/vault v0.10.3
-	github.com/hashicorp/vault-k8s v0.5.0
-	github.com/hashicorp/vault/sdk v0.1.14-0.20191205220236-47cffd09f972
-	github.com/mattbaird/jsonpatch v0.0.0-20200820163806-098863c1fc24
-	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/radovskyb/watcher v1.0.7
 	github.com/rs/zerolog v1.19.0
+	github.com/ryanuber/go-glob v1.0.0 // indirect
 	github.com/spf13/cobra v1.0.0
-	github.com/stretchr/testify v1.4.0
-	go.opencensus.io v0.22.5 // indirect
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	gomodules.xyz/jsonpatch/v2 v2.1.0
 	google.golang.org/genproto v0.0.0-20201022181438-0ff5f38871d5
-	k8s.io/api v0.0.0-20190409021203-6e4e0e4f393b
-	k8s.io/apimachinery v0.0.0-20190404173353-6a84e37a896d
-	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
-	k8s.io/klog v1.0.0 // indirect
-	k8s.io/utils v0.0.0-20191030222137-2b95a09bc58d // indirect
-	sigs.k8s.io/yaml v1.1.0 // indirect
+	google.golang.org/grpc v1.32.0
+	gopkg.in/yaml.v3 v3.0.1
+	k8s.io/api v0.19.16
+	k8s.io/apimachinery v0.19.16
+	k8s.io/client-go v0.19.16
+	sigs.k8s.io/yaml v1.2.0
 )
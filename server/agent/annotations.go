@@ -3,4 +3,6 @@ package agent
 const (
 	AnnotationIgnoreCheck = "satpolpp.imrenagi.com/ignore-check"
 	AnnotationShouldCheck = "satpolpp.imrenagi.com/should-check"
+	// AnnotationAllowFindings lists the findings allowed in a configmap
+	AnnotationAllowFindings = "satpolpp.imrenagi.com/allow-findings"
 )
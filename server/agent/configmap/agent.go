@@ -3,43 +3,189 @@ package configmap
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	dlp "cloud.google.com/go/dlp/apiv2"
 	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/redact"
 	"github.com/rs/zerolog/log"
-	dlppb "google.golang.org/genproto/googleapis/privacy/dlp/v2"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// defaultInspectTimeout bounds an inspection when the caller sets no deadline
+const defaultInspectTimeout = 10 * time.Second
+
+var (
+	projectIDPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	infoTypePattern  = regexp.MustCompile(`^[A-Z0-9_]+$`)
+
+	// DefaultInfoTypes are inspected when the policy does not list any
+	DefaultInfoTypes = []string{
+		"AUTH_TOKEN",
+		"AWS_CREDENTIALS",
+		"BASIC_AUTH_HEADER",
+		"GCP_CREDENTIALS",
+		"GCP_API_KEY",
+		"JSON_WEB_TOKEN",
+		"PASSWORD",
+		"WEAK_PASSWORD_HASH",
+		"ENCRYPTION_KEY",
+	}
+)
+
+// AgentConfig is the configmap section of the policy file
 type AgentConfig struct {
-	GoogleProjectID string
+	// Detector is either `dlp` (the default) or `offline`
+	Detector        string   `json:"detector,omitempty"`
+	GoogleProjectID string   `json:"googleProjectID,omitempty"`
+	InfoTypes       []string `json:"infoTypes,omitempty"`
+	// MinLikelihood is the least likely finding which is a violation,
+	// POSSIBLE when empty
+	MinLikelihood   string           `json:"minLikelihood,omitempty"`
+	CustomInfoTypes []CustomInfoType `json:"customInfoTypes,omitempty"`
+	ExclusionRules  []ExclusionRule  `json:"exclusionRules,omitempty"`
+	AllowedFindings []AllowedFinding `json:"allowedFindings,omitempty"`
+	// Censor renders the secrets in the violations
+	Censor redact.Censor `json:"censor,omitempty"`
+	// MoveSecrets lets the mutating webhook move the secrets found in
+	// configmaps into a companion Secret. It is off by default.
+	MoveSecrets *bool `json:"moveSecrets,omitempty"`
+}
+
+// MovesSecrets reports whether the secrets of configmaps are moved into a
+// companion Secret
+func (c AgentConfig) MovesSecrets() bool {
+	return c.MoveSecrets != nil && *c.MoveSecrets
+}
+
+// Merge returns a copy of c extended by o. Info types, exclusion rules and
+// allowed findings of both are used, the info types of an empty c being the
+// default ones. A custom info type of o replaces the one of c with the same
+// name, while the detector, project, minimum likelihood, censor fields and
+// moveSecrets of o win when they are set.
+func (c AgentConfig) Merge(o AgentConfig) AgentConfig {
+	merged := c
+	if o.Detector != "" {
+		merged.Detector = o.Detector
+	}
+	if o.GoogleProjectID != "" {
+		merged.GoogleProjectID = o.GoogleProjectID
+	}
+	if o.MinLikelihood != "" {
+		merged.MinLikelihood = o.MinLikelihood
+	}
+	merged.Censor = c.Censor.Merge(o.Censor)
+	if o.MoveSecrets != nil {
+		merged.MoveSecrets = o.MoveSecrets
+	}
+	// the defaults of an empty c are extended too, rather than replaced
+	base := c.InfoTypes
+	if len(base) == 0 && len(o.InfoTypes) > 0 {
+		base = DefaultInfoTypes
+	}
+	merged.InfoTypes = agent.MergeStrings(base, o.InfoTypes)
+
+	merged.CustomInfoTypes = nil
+	for _, t := range c.CustomInfoTypes {
+		if !hasCustomInfoType(o.CustomInfoTypes, t.Name) {
+			merged.CustomInfoTypes = append(merged.CustomInfoTypes, t)
+		}
+	}
+	merged.CustomInfoTypes = append(merged.CustomInfoTypes, o.CustomInfoTypes...)
+
+	merged.ExclusionRules = nil
+	merged.ExclusionRules = append(merged.ExclusionRules, c.ExclusionRules...)
+	merged.ExclusionRules = append(merged.ExclusionRules, o.ExclusionRules...)
+
+	merged.AllowedFindings = nil
+	merged.AllowedFindings = append(merged.AllowedFindings, c.AllowedFindings...)
+	merged.AllowedFindings = append(merged.AllowedFindings, o.AllowedFindings...)
+	return merged
+}
+
+func hasCustomInfoType(types []CustomInfoType, name string) bool {
+	for _, t := range types {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
+// Validate returns all the problems found in the config. Each error message
+// starts with the name of the offending field.
+func (c AgentConfig) Validate() []error {
+	var errs []error
+	switch c.Detector {
+	case "", DetectorDLP:
+		switch {
+		case c.GoogleProjectID == "":
+			errs = append(errs, fmt.Errorf("googleProjectID: must not be empty"))
+		case !projectIDPattern.MatchString(c.GoogleProjectID):
+			errs = append(errs, fmt.Errorf("googleProjectID: %q is not a valid google cloud project id", c.GoogleProjectID))
+		}
+	case DetectorOffline:
+	default:
+		errs = append(errs, fmt.Errorf("detector: must be one of %s or %s", DetectorDLP, DetectorOffline))
+	}
+	for i, infoType := range c.InfoTypes {
+		switch {
+		case !infoTypePattern.MatchString(infoType):
+			errs = append(errs, fmt.Errorf("infoTypes[%d]: %q is not a valid info type name", i, infoType))
+		case c.Detector == DetectorOffline && !SupportsInfoType(infoType):
+			errs = append(errs, fmt.Errorf("infoTypes[%d]: %q is not supported by the offline detector", i, infoType))
+		}
+	}
+	if c.MinLikelihood != "" {
+		if _, err := ParseLikelihood(c.MinLikelihood); err != nil {
+			errs = append(errs, fmt.Errorf("minLikelihood: %s", err))
+		}
+	}
+	names := make(map[string]bool, len(c.CustomInfoTypes))
+	for i, t := range c.CustomInfoTypes {
+		field := fmt.Sprintf("customInfoTypes[%d]", i)
+		errs = append(errs, t.validate(field)...)
+		if names[t.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: %q is defined more than once", field, t.Name))
+		}
+		names[t.Name] = true
+	}
+	for i, r := range c.ExclusionRules {
+		errs = append(errs, r.validate(fmt.Sprintf("exclusionRules[%d]", i))...)
+	}
+	for i, f := range c.AllowedFindings {
+		errs = append(errs, f.validate(fmt.Sprintf("allowedFindings[%d]", i))...)
+	}
+	for _, err := range c.Censor.Validate() {
+		errs = append(errs, fmt.Errorf("censor.%s", err))
+	}
+	return errs
+}
+
+// Agent validates configmaps. It is safe for concurrent use.
 type Agent struct {
-	dlpclient *dlp.Client
-	cfg       *AgentConfig
+	detector Detector
+	cfg      *AgentConfig
 }
 
-// New ...
-func New(cfg *AgentConfig) (*Agent, error) {
+// New creates an agent which inspects configmaps with the given detector. The
+// detector is not owned by the agent, so it can be shared with other agents.
+func New(cfg *AgentConfig, detector Detector) (*Agent, error) {
 
 	if cfg == nil {
 		return nil, fmt.Errorf("agent config cant be nil")
 	}
-
-	ctx := context.Background()
-	dlpclient, err := dlp.NewClient(ctx)
-	if err != nil {
-		return nil, err
+	if detector == nil {
+		return nil, fmt.Errorf("detector cant be nil")
 	}
-	log.Debug().Msg("dlpclient is created")
 
 	agent := &Agent{
-		dlpclient: dlpclient,
-		cfg:       cfg,
+		detector: detector,
+		cfg:      cfg,
 	}
 	return agent, nil
 }
@@ -59,68 +205,194 @@ func ShouldCheck(configmap corev1.ConfigMap) (bool, error) {
 	return check, nil
 }
 
-// Validate ...
-func (a *Agent) Validate(configmap corev1.ConfigMap) error {
+// Validate inspects the configmap data, text binary data, labels and
+// annotations for secrets. Every key is parsed by its format and each finding is returned as a violation
+// naming the key and line it was found in, unless it is allowed by the policy
+// or the `allow-findings` annotation. The error is only set when the
+// inspection failed.
+func (a *Agent) Validate(ctx context.Context, configmap corev1.ConfigMap) (agent.Violations, error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	allowed, err := AnnotatedAllowedFindings(configmap.ObjectMeta)
+	if err != nil {
+		return nil, err
+	}
+	allowed = append(allowed, a.cfg.AllowedFindings...)
 
+	segs := append(segments(configmap.Data, configmap.BinaryData), metadataSegments(configmap.ObjectMeta)...)
+	findings, err := a.inspect(ctx, segs)
+	if err != nil {
+		return nil, err
+	}
+	findings = withoutLastAppliedCopies(findings)
+
+	var violations agent.Violations
+	for _, f := range findings {
+		field, key, location := "data", "", ""
+		if seg := f.segment; seg != nil {
+			field, key, location = seg.Field, seg.Key, fmt.Sprintf("key %q line %d: ", seg.Key, seg.Line)
+			if seg.Location != "" {
+				location = seg.Location + ": "
+			}
+		}
+
+		hash := redact.Hash(f.Quote)
+		if a.allowed(configmap.ObjectMeta, allowed, key, f.InfoType, hash) {
+			continue
+		}
+		message := fmt.Sprintf("%s%s -> detected as %s (%s)", location, a.cfg.Censor.Apply(f.Quote), f.InfoType, f.Likelihood.String())
+		if h := a.cfg.Censor.Hash(f.Quote); h != "" {
+			message += ", hash " + h
+		}
+		violations = append(violations, agent.Violation{
+			RuleID:      agent.RuleConfigMapSecret,
+			Field:       field,
+			Message:     message,
+			Fingerprint: redact.Fingerprint(f.Quote),
+		})
+	}
+
+	return violations, nil
+}
+
+// locatedFinding is a finding and the segment it was found in, which is nil
+// when the finding could not be located
+type locatedFinding struct {
+	Finding
+	segment *segment
+	// offset is the byte offset of the quote in the text of the segment
+	offset int
+}
+
+// withoutLastAppliedCopies drops the findings of the last-applied-configuration
+// annotation which were also found elsewhere in the object, as the annotation
+// usually repeats the object itself
+func withoutLastAppliedCopies(findings []locatedFinding) []locatedFinding {
+	inLastApplied := func(f locatedFinding) bool {
+		return f.segment != nil && f.segment.Field == fmt.Sprintf("metadata.annotations[%s]", lastAppliedAnnotation)
+	}
+	found := make(map[string]bool)
+	for _, f := range findings {
+		if !inLastApplied(f) {
+			found[f.InfoType+"/"+f.Quote] = true
+		}
+	}
+	kept := findings[:0]
+	for _, f := range findings {
+		if !inLastApplied(f) || !found[f.InfoType+"/"+f.Quote] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// inspect sends the segments to the detector as one text and returns the
+// findings which are at least as likely as the minimum. The inspection is
+// given up at the deadline of ctx, or after 10 seconds when ctx has none.
+func (a *Agent) inspect(ctx context.Context, segs []segment) ([]locatedFinding, error) {
+	if len(segs) == 0 {
+		return nil, nil
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultInspectTimeout)
+		defer cancel()
+	}
+
+	// every segment is a line of the inspected text, so that findings can be
+	// mapped back to where they were found
 	var b strings.Builder
-	for k, v := range configmap.Data {
-		fmt.Fprintf(&b, "%s: %s\n", k, v)
+	starts := make([]int, len(segs))
+	for i, seg := range segs {
+		starts[i] = b.Len()
+		b.WriteString(seg.Text)
+		b.WriteString("\n")
 	}
 	textToInspect := b.String()
 
-	log.Debug().Str("text", textToInspect).Msg("text to inspect is constructed")
-
-	// Create and send the request.
-	req := &dlppb.InspectContentRequest{
-		Parent: fmt.Sprintf("projects/%s/locations/global", a.cfg.GoogleProjectID),
-		Item: &dlppb.ContentItem{
-			DataItem: &dlppb.ContentItem_Value{
-				Value: textToInspect,
-			},
-		},
-		InspectConfig: &dlppb.InspectConfig{
-			InfoTypes: []*dlppb.InfoType{
-				{Name: "AUTH_TOKEN"},
-				{Name: "AWS_CREDENTIALS"},
-				{Name: "BASIC_AUTH_HEADER"},
-				{Name: "GCP_CREDENTIALS"},
-				{Name: "GCP_API_KEY"},
-				{Name: "JSON_WEB_TOKEN"},
-				{Name: "PASSWORD"},
-				{Name: "WEAK_PASSWORD_HASH"},
-				{Name: "ENCRYPTION_KEY"},
-			},
-			IncludeQuote: true,
-		},
-	}
-	resp, err := a.dlpclient.InspectContent(ctx, req)
+	log.Debug().Int("segments", len(segs)).Str("text", redact.Text(textToInspect)).Msg("text to inspect is constructed")
+
+	minLikelihood := a.minLikelihood()
+	findings, err := a.detector.Inspect(ctx, InspectRequest{
+		Text:            textToInspect,
+		InfoTypes:       a.infoTypes(),
+		CustomInfoTypes: a.cfg.CustomInfoTypes,
+		ExclusionRules:  a.cfg.ExclusionRules,
+		MinLikelihood:   minLikelihood,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Debug().Msg("dlp inspection is completed")
-
-	var msgb strings.Builder
-	result := resp.Result
-	for _, f := range result.Findings {
+	placeholders := placeholderPattern.FindAllStringIndex(textToInspect, -1)
+	var located []locatedFinding
+	for _, f := range findings {
 		log.Debug().
-			Str("quote", f.Quote).
-			Str("info_type", f.InfoType.Name).
+			Str("fingerprint", redact.Fingerprint(f.Quote)).
+			Str("info_type", f.InfoType).
 			Str("likelihood", f.Likelihood.String()).
 			Msg("possible detection")
 
-		if f.Likelihood >= dlppb.Likelihood_POSSIBLE {
-			fmt.Fprintf(&msgb, "\n%s -> detected as %s (%s)", censor(f.Quote), f.InfoType.Name, f.Likelihood.String())
+		if f.Likelihood < minLikelihood {
+			continue
+		}
+
+		l := locatedFinding{Finding: f}
+		offset := f.Offset
+		if offset < 0 {
+			offset = strings.Index(textToInspect, f.Quote)
+		}
+		if offset >= 0 && inPlaceholder(placeholders, offset, offset+len(f.Quote)) {
+			continue
 		}
+		if offset >= 0 {
+			i := sort.Search(len(starts), func(i int) bool { return starts[i] > offset }) - 1
+			l.segment, l.offset = &segs[i], offset-starts[i]
+		}
+		located = append(located, l)
 	}
+	return located, nil
+}
+
+func (a *Agent) infoTypes() []string {
+	if len(a.cfg.InfoTypes) == 0 {
+		return DefaultInfoTypes
+	}
+	return a.cfg.InfoTypes
+}
 
-	msg := msgb.String()
-	if msg != "" {
-		return fmt.Errorf(msg)
+func (a *Agent) minLikelihood() Likelihood {
+	if l, err := ParseLikelihood(a.cfg.MinLikelihood); err == nil {
+		return l
 	}
+	return LikelihoodPossible
+}
 
-	return nil
+// allowed reports whether an unexpired entry allows the finding. Every entry
+// which applies is logged, so that suppressed findings can still be reviewed.
+func (a *Agent) allowed(meta metav1.ObjectMeta, allowed []AllowedFinding, key, infoType, hash string) bool {
+	now := time.Now()
+	for _, entry := range allowed {
+		if !entry.matches(meta.Namespace, meta.Name, key, hash) {
+			continue
+		}
+		event := log.Info()
+		if entry.expired(now) {
+			event = log.Warn()
+		}
+		event = event.
+			Str("namespace", meta.Namespace).
+			Str("name", meta.Name).
+			Str("key", key).
+			Str("info_type", infoType).
+			Str("hash", hash).
+			Str("reason", entry.Reason)
+		if entry.expired(now) {
+			event.Time("expires", entry.Expires.Time).Msg("allowed finding has expired")
+			continue
+		}
+		event.Msg("finding is allowed")
+		return true
+	}
+	return false
 }
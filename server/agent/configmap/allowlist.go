@@ -0,0 +1,70 @@
+package configmap
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+var hashPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// AllowedFinding suppresses a known false positive, such as a sample password
+// in the docs. The finding is identified by the HMAC of its quote, keyed with
+// the hash key of the server, so the secret itself is never stored. An empty
+// namespace, name or key matches every one.
+type AllowedFinding struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Key       string `json:"key,omitempty"`
+	// Hash is the hex encoded HMAC-SHA256 of the quote, as shown in the
+	// violation
+	Hash string `json:"hash"`
+	// Expires is when the entry stops applying, never when empty
+	Expires *metav1.Time `json:"expires,omitempty"`
+	Reason  string       `json:"reason,omitempty"`
+}
+
+func (f AllowedFinding) validate(field string) []error {
+	if !hashPattern.MatchString(f.Hash) {
+		return []error{fmt.Errorf("%s.hash: must be a lowercase hex encoded HMAC-SHA256", field)}
+	}
+	return nil
+}
+
+func (f AllowedFinding) matches(namespace, name, key, hash string) bool {
+	return f.Hash == hash &&
+		(f.Namespace == "" || f.Namespace == namespace) &&
+		(f.Name == "" || f.Name == name) &&
+		(f.Key == "" || f.Key == key)
+}
+
+func (f AllowedFinding) expired(now time.Time) bool {
+	return f.Expires != nil && !now.Before(f.Expires.Time)
+}
+
+// AnnotatedAllowedFindings returns the allowed findings listed in the
+// `allow-findings` annotation of a configmap or workload, which only apply to
+// the object itself. The annotation is a JSON or YAML list of entries.
+func AnnotatedAllowedFindings(configmap metav1.ObjectMeta) ([]AllowedFinding, error) {
+	raw, ok := configmap.Annotations[agent.AnnotationAllowFindings]
+	if !ok {
+		return nil, nil
+	}
+
+	var allowed []AllowedFinding
+	if err := yaml.UnmarshalStrict([]byte(raw), &allowed); err != nil {
+		return nil, fmt.Errorf("%s: %w", agent.AnnotationAllowFindings, err)
+	}
+	for i := range allowed {
+		if errs := allowed[i].validate(fmt.Sprintf("%s[%d]", agent.AnnotationAllowFindings, i)); len(errs) > 0 {
+			return nil, errs[0]
+		}
+		allowed[i].Namespace = configmap.Namespace
+		allowed[i].Name = configmap.Name
+	}
+	return allowed, nil
+}
@@ -0,0 +1,88 @@
+package configmap
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/imrenagi/satpol-pp/server/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// breakerThreshold is the number of consecutive failures opening the circuit
+	breakerThreshold = 5
+	// breakerCooldown is how long the circuit stays open before a call is
+	// tried again
+	breakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of calling a detector which keeps failing
+var ErrCircuitOpen = errors.New("detector is unavailable after repeated failures, circuit breaker is open")
+
+// breaker stops calling a detector after repeated failures, so that an outage
+// fails requests right away instead of after a timeout each. After the cooldown
+// one call is let through, and the circuit closes again when it succeeds.
+type breaker struct {
+	Detector
+	name string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(name string, d Detector) *breaker {
+	return &breaker{Detector: d, name: name}
+}
+
+// Inspect ...
+func (b *breaker) Inspect(ctx context.Context, req InspectRequest) ([]Finding, error) {
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	findings, err := b.Detector.Inspect(ctx, req)
+	b.done(err)
+	return findings, err
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if err == nil {
+		if b.failures >= breakerThreshold {
+			log.Info().Str("detector", b.name).Msg("detector recovered, circuit breaker is closed")
+			metrics.DetectorCircuitOpen.WithLabelValues(b.name).Set(0)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold {
+		if b.failures == breakerThreshold {
+			log.Warn().Err(err).Str("detector", b.name).Dur("cooldown", breakerCooldown).Msg("detector keeps failing, circuit breaker is open")
+			metrics.DetectorCircuitOpen.WithLabelValues(b.name).Set(1)
+		}
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
@@ -0,0 +1,162 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/redact"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// container is the part of regular, init and ephemeral containers which may
+// hold hardcoded secrets
+type container struct {
+	// Kind is how the container is called in the violations
+	Kind string
+	// Field is the path of the container inside the pod spec
+	Field   string
+	Name    string
+	Command []string
+	Args    []string
+	Env     []corev1.EnvVar
+}
+
+// ValidateWorkload inspects the labels and annotations of a workload, and the
+// literal env values, command and args of every container of its pods for
+// secrets. Env values read with `valueFrom`, e.g. from a secretKeyRef, are the
+// compliant pattern and are never inspected. Findings are allowed like in
+// configmaps, where the key is the name of the container or of the label or
+// annotation. Fields of the violations are relative to the workload, where
+// podSpecField is the path of the pod spec.
+func (a *Agent) ValidateWorkload(ctx context.Context, meta metav1.ObjectMeta, pod corev1.PodSpec, podSpecField string) (agent.Violations, error) {
+	allowed, err := AnnotatedAllowedFindings(meta)
+	if err != nil {
+		return nil, err
+	}
+	allowed = append(allowed, a.cfg.AllowedFindings...)
+
+	segs := metadataSegments(meta)
+	for _, c := range podContainers(pod) {
+		c.Field = podSpecField + c.Field
+		segs = append(segs, containerSegments(c)...)
+	}
+
+	findings, err := a.inspect(ctx, segs)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations agent.Violations
+	for _, f := range withoutLastAppliedCopies(findings) {
+		key := ""
+		if f.segment != nil {
+			key = f.segment.Key
+		}
+		if a.allowed(meta, allowed, key, f.InfoType, redact.Hash(f.Quote)) {
+			continue
+		}
+		message := fmt.Sprintf("%s -> detected as %s (%s)", a.cfg.Censor.Apply(f.Quote), f.InfoType, f.Likelihood.String())
+		if h := a.cfg.Censor.Hash(f.Quote); h != "" {
+			message += ", hash " + h
+		}
+		violation := agent.Violation{
+			RuleID:      agent.RuleWorkloadSecret,
+			Message:     message,
+			Fingerprint: redact.Fingerprint(f.Quote),
+		}
+		if f.segment != nil {
+			if !strings.HasPrefix(f.segment.Field, "metadata.") {
+				violation.Container = f.segment.Key
+			}
+			violation.Field = f.segment.Field
+			violation.Message = fmt.Sprintf("%s: %s", f.segment.Location, violation.Message)
+		}
+		violations = append(violations, violation)
+	}
+	return violations, nil
+}
+
+// containerSegments returns the literal values of the container. Env values
+// are inspected next to the name of the variable, and an argument following
+// a flag such as `--password` is inspected next to the flag.
+func containerSegments(c container) []segment {
+	var segs []segment
+	for i, env := range c.Env {
+		if env.ValueFrom != nil || strings.TrimSpace(env.Value) == "" {
+			continue
+		}
+		segs = append(segs, segment{
+			Field:    fmt.Sprintf("%s.env[%d].value", c.Field, i),
+			Key:      c.Name,
+			Location: fmt.Sprintf("%s %s env %s", c.Kind, c.Name, env.Name),
+			Text:     fmt.Sprintf("%s: %s", env.Name, env.Value),
+		})
+	}
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{"command", c.Command},
+		{"args", c.Args},
+	} {
+		for i, value := range list.values {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			text := value
+			if i > 0 && isFlag(list.values[i-1]) && !isFlag(value) {
+				text = list.values[i-1] + "=" + value
+			}
+			segs = append(segs, segment{
+				Field:    fmt.Sprintf("%s.%s[%d]", c.Field, list.name, i),
+				Key:      c.Name,
+				Location: fmt.Sprintf("%s %s %s[%d]", c.Kind, c.Name, list.name, i),
+				Text:     text,
+			})
+		}
+	}
+	return segs
+}
+
+// isFlag reports whether the argument is a flag waiting for its value
+func isFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=")
+}
+
+func podContainers(pod corev1.PodSpec) []container {
+	var containers []container
+	for i, c := range pod.Containers {
+		containers = append(containers, container{
+			Kind:    "container",
+			Field:   fmt.Sprintf("containers[%d]", i),
+			Name:    c.Name,
+			Command: c.Command,
+			Args:    c.Args,
+			Env:     c.Env,
+		})
+	}
+	for i, c := range pod.InitContainers {
+		containers = append(containers, container{
+			Kind:    "init container",
+			Field:   fmt.Sprintf("initContainers[%d]", i),
+			Name:    c.Name,
+			Command: c.Command,
+			Args:    c.Args,
+			Env:     c.Env,
+		})
+	}
+	for i, c := range pod.EphemeralContainers {
+		containers = append(containers, container{
+			Kind:    "ephemeral container",
+			Field:   fmt.Sprintf("ephemeralContainers[%d]", i),
+			Name:    c.Name,
+			Command: c.Command,
+			Args:    c.Args,
+			Env:     c.Env,
+		})
+	}
+	return containers
+}
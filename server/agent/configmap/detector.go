@@ -0,0 +1,88 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+)
+
+// Names of the detector backends which can be set in the policy
+const (
+	DetectorDLP     = "dlp"
+	DetectorOffline = "offline"
+)
+
+// Likelihood is how likely a finding is a real secret. The levels are the
+// same as the ones of Cloud DLP.
+type Likelihood int
+
+// Likelihood levels, from the least to the most likely
+const (
+	LikelihoodUnspecified Likelihood = iota
+	LikelihoodVeryUnlikely
+	LikelihoodUnlikely
+	LikelihoodPossible
+	LikelihoodLikely
+	LikelihoodVeryLikely
+)
+
+var likelihoodNames = []string{
+	"LIKELIHOOD_UNSPECIFIED",
+	"VERY_UNLIKELY",
+	"UNLIKELY",
+	"POSSIBLE",
+	"LIKELY",
+	"VERY_LIKELY",
+}
+
+func (l Likelihood) String() string {
+	if l < 0 || int(l) >= len(likelihoodNames) {
+		return likelihoodNames[LikelihoodUnspecified]
+	}
+	return likelihoodNames[l]
+}
+
+// Finding is a possible secret found by a Detector
+type Finding struct {
+	InfoType   string
+	Quote      string
+	Likelihood Likelihood
+	// Offset is the byte offset of the quote in the inspected text, or -1
+	// when the detector does not know it
+	Offset int
+}
+
+// InspectRequest is the text to inspect and the info types to look for
+type InspectRequest struct {
+	Text      string
+	InfoTypes []string
+	// CustomInfoTypes are looked for in addition to InfoTypes
+	CustomInfoTypes []CustomInfoType
+	// ExclusionRules drop the findings matching them
+	ExclusionRules []ExclusionRule
+	// MinLikelihood is the least likely finding to return
+	MinLikelihood Likelihood
+}
+
+// Detector finds secrets in text. Detectors are long lived and shared by
+// concurrent requests, so implementations must be safe for concurrent use.
+type Detector interface {
+	Inspect(ctx context.Context, req InspectRequest) ([]Finding, error)
+	// Close releases the resources held by the detector
+	Close() error
+}
+
+// NewDetector creates the detector backend chosen in the config
+func NewDetector(ctx context.Context, cfg *AgentConfig) (Detector, error) {
+	switch cfg.Detector {
+	case "", DetectorDLP:
+		d, err := NewDLPDetector(ctx, cfg.GoogleProjectID)
+		if err != nil {
+			return nil, err
+		}
+		return newBreaker(DetectorDLP, d), nil
+	case DetectorOffline:
+		return NewOfflineDetector(), nil
+	default:
+		return nil, fmt.Errorf("unknown detector %q", cfg.Detector)
+	}
+}
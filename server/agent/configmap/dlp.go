@@ -0,0 +1,146 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dlp "cloud.google.com/go/dlp/apiv2"
+	"github.com/imrenagi/satpol-pp/server/metrics"
+	"github.com/rs/zerolog/log"
+	dlppb "google.golang.org/genproto/googleapis/privacy/dlp/v2"
+	"google.golang.org/grpc/status"
+)
+
+// DLPDetector inspects text with Google Cloud DLP
+type DLPDetector struct {
+	client    *dlp.Client
+	projectID string
+}
+
+// NewDLPDetector creates a DLP client which calls the api on behalf of the
+// given project
+func NewDLPDetector(ctx context.Context, projectID string) (*DLPDetector, error) {
+	client, err := dlp.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Msg("dlpclient is created")
+
+	return &DLPDetector{
+		client:    client,
+		projectID: projectID,
+	}, nil
+}
+
+// Inspect ...
+func (d *DLPDetector) Inspect(ctx context.Context, req InspectRequest) ([]Finding, error) {
+	infoTypes := make([]*dlppb.InfoType, 0, len(req.InfoTypes))
+	for _, name := range req.InfoTypes {
+		infoTypes = append(infoTypes, &dlppb.InfoType{Name: name})
+	}
+
+	// Create and send the request.
+	start := time.Now()
+	resp, err := d.client.InspectContent(ctx, &dlppb.InspectContentRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/global", d.projectID),
+		Item: &dlppb.ContentItem{
+			DataItem: &dlppb.ContentItem_Value{
+				Value: req.Text,
+			},
+		},
+		InspectConfig: &dlppb.InspectConfig{
+			InfoTypes:       infoTypes,
+			CustomInfoTypes: dlpCustomInfoTypes(req.CustomInfoTypes),
+			RuleSet:         dlpRuleSet(req),
+			MinLikelihood:   dlppb.Likelihood(req.MinLikelihood),
+			IncludeQuote:    true,
+		},
+	})
+	metrics.DLPInspectDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.DLPInspectErrors.WithLabelValues(status.Code(err).String()).Inc()
+		return nil, err
+	}
+
+	log.Debug().Msg("dlp inspection is completed")
+
+	findings := make([]Finding, 0, len(resp.Result.Findings))
+	for _, f := range resp.Result.Findings {
+		offset := -1
+		if r := f.GetLocation().GetByteRange(); r != nil {
+			offset = int(r.Start)
+		}
+		findings = append(findings, Finding{
+			InfoType:   f.InfoType.Name,
+			Quote:      f.Quote,
+			Likelihood: Likelihood(f.Likelihood),
+			Offset:     offset,
+		})
+	}
+	return findings, nil
+}
+
+// Close closes the connection to the DLP api
+func (d *DLPDetector) Close() error {
+	return d.client.Close()
+}
+
+func dlpCustomInfoTypes(types []CustomInfoType) []*dlppb.CustomInfoType {
+	custom := make([]*dlppb.CustomInfoType, 0, len(types))
+	for _, t := range types {
+		c := &dlppb.CustomInfoType{
+			InfoType:   &dlppb.InfoType{Name: t.Name},
+			Likelihood: dlppb.Likelihood(t.likelihood()),
+		}
+		if t.Regex != "" {
+			c.Type = &dlppb.CustomInfoType_Regex_{Regex: &dlppb.CustomInfoType_Regex{Pattern: t.Regex}}
+		} else {
+			c.Type = &dlppb.CustomInfoType_Dictionary_{Dictionary: dlpDictionary(t.Dictionary)}
+		}
+		custom = append(custom, c)
+	}
+	return custom
+}
+
+// dlpRuleSet turns every exclusion rule into a rule set, since the info types
+// of a rule set apply to all of its rules. A rule without info types applies
+// to every inspected one.
+func dlpRuleSet(req InspectRequest) []*dlppb.InspectionRuleSet {
+	all := append([]string{}, req.InfoTypes...)
+	for _, t := range req.CustomInfoTypes {
+		all = append(all, t.Name)
+	}
+
+	ruleSet := make([]*dlppb.InspectionRuleSet, 0, len(req.ExclusionRules))
+	for _, r := range req.ExclusionRules {
+		names := r.InfoTypes
+		if len(names) == 0 {
+			names = all
+		}
+		infoTypes := make([]*dlppb.InfoType, 0, len(names))
+		for _, name := range names {
+			infoTypes = append(infoTypes, &dlppb.InfoType{Name: name})
+		}
+
+		rule := &dlppb.ExclusionRule{MatchingType: dlppb.MatchingType_MATCHING_TYPE_FULL_MATCH}
+		if r.Regex != "" {
+			rule.Type = &dlppb.ExclusionRule_Regex{Regex: &dlppb.CustomInfoType_Regex{Pattern: r.Regex}}
+		} else {
+			rule.Type = &dlppb.ExclusionRule_Dictionary{Dictionary: dlpDictionary(r.Dictionary)}
+		}
+		ruleSet = append(ruleSet, &dlppb.InspectionRuleSet{
+			InfoTypes: infoTypes,
+			Rules:     []*dlppb.InspectionRule{{Type: &dlppb.InspectionRule_ExclusionRule{ExclusionRule: rule}}},
+		})
+	}
+	return ruleSet
+}
+
+func dlpDictionary(words []string) *dlppb.CustomInfoType_Dictionary {
+	return &dlppb.CustomInfoType_Dictionary{
+		Source: &dlppb.CustomInfoType_Dictionary_WordList_{
+			WordList: &dlppb.CustomInfoType_Dictionary_WordList{Words: words},
+		},
+	}
+}
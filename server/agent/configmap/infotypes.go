@@ -0,0 +1,141 @@
+package configmap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// compiled caches the expressions of the policy, which are matched by every
+// inspection of the offline detector
+var compiled sync.Map
+
+func compileCached(expr string) (*regexp.Regexp, error) {
+	if re, ok := compiled.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	compiled.Store(expr, re)
+	return re, nil
+}
+
+// CustomInfoType is an info type defined by the policy, e.g. for the format of
+// internal tokens. Exactly one of Regex or Dictionary must be set.
+type CustomInfoType struct {
+	Name string `json:"name"`
+	// Regex is an RE2 expression whose whole match is the finding
+	Regex string `json:"regex,omitempty"`
+	// Dictionary is a list of words or phrases, matched case insensitively
+	Dictionary []string `json:"dictionary,omitempty"`
+	// Likelihood of the findings, VERY_LIKELY when empty
+	Likelihood string `json:"likelihood,omitempty"`
+}
+
+func (t CustomInfoType) likelihood() Likelihood {
+	if t.Likelihood == "" {
+		return LikelihoodVeryLikely
+	}
+	l, _ := ParseLikelihood(t.Likelihood)
+	return l
+}
+
+func (t CustomInfoType) validate(field string) []error {
+	var errs []error
+	if !infoTypePattern.MatchString(t.Name) {
+		errs = append(errs, fmt.Errorf("%s.name: %q is not a valid info type name", field, t.Name))
+	}
+	if t.Likelihood != "" {
+		if _, err := ParseLikelihood(t.Likelihood); err != nil {
+			errs = append(errs, fmt.Errorf("%s.likelihood: %s", field, err))
+		}
+	}
+	return append(errs, validateMatcher(field, t.Regex, t.Dictionary)...)
+}
+
+// ExclusionRule drops the findings of the listed info types which fully match
+// the regex or one of the dictionary words, e.g. well known example values.
+// Exactly one of Regex or Dictionary must be set.
+type ExclusionRule struct {
+	// InfoTypes the rule applies to, every inspected one when empty
+	InfoTypes  []string `json:"infoTypes,omitempty"`
+	Regex      string   `json:"regex,omitempty"`
+	Dictionary []string `json:"dictionary,omitempty"`
+}
+
+func (r ExclusionRule) validate(field string) []error {
+	var errs []error
+	for i, infoType := range r.InfoTypes {
+		if !infoTypePattern.MatchString(infoType) {
+			errs = append(errs, fmt.Errorf("%s.infoTypes[%d]: %q is not a valid info type name", field, i, infoType))
+		}
+	}
+	return append(errs, validateMatcher(field, r.Regex, r.Dictionary)...)
+}
+
+// excludes reports whether the rule drops the finding
+func (r ExclusionRule) excludes(f Finding) bool {
+	if len(r.InfoTypes) > 0 && !contains(r.InfoTypes, f.InfoType) {
+		return false
+	}
+	if r.Regex != "" {
+		re, err := compileCached(`^(?:` + r.Regex + `)$`)
+		return err == nil && re.MatchString(f.Quote)
+	}
+	for _, word := range r.Dictionary {
+		if strings.EqualFold(word, f.Quote) {
+			return true
+		}
+	}
+	return false
+}
+
+// dictionaryPattern matches any of the words on word boundaries
+func dictionaryPattern(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(strings.TrimSpace(word))
+	}
+	return `(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`
+}
+
+func validateMatcher(field, regex string, dictionary []string) []error {
+	switch {
+	case regex == "" && len(dictionary) == 0:
+		return []error{fmt.Errorf("%s: one of regex or dictionary must be set", field)}
+	case regex != "" && len(dictionary) > 0:
+		return []error{fmt.Errorf("%s: only one of regex or dictionary can be set", field)}
+	case regex != "":
+		if _, err := regexp.Compile(regex); err != nil {
+			return []error{fmt.Errorf("%s.regex: %s", field, err)}
+		}
+	}
+	for i, word := range dictionary {
+		if strings.TrimSpace(word) == "" {
+			return []error{fmt.Errorf("%s.dictionary[%d]: must not be empty", field, i)}
+		}
+	}
+	return nil
+}
+
+// ParseLikelihood parses the name of a likelihood level, e.g. `POSSIBLE`
+func ParseLikelihood(name string) (Likelihood, error) {
+	for i, n := range likelihoodNames {
+		if i != int(LikelihoodUnspecified) && n == name {
+			return Likelihood(i), nil
+		}
+	}
+	return LikelihoodUnspecified, fmt.Errorf("%q must be one of %s", name, strings.Join(likelihoodNames[1:], ", "))
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
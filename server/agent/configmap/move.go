@@ -0,0 +1,260 @@
+package configmap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/imrenagi/satpol-pp/server/redact"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// lastAppliedAnnotation holds the manifest last applied by `kubectl apply`
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+var (
+	// placeholderPattern matches the placeholders of moved secrets, which
+	// are never reported as findings themselves
+	placeholderPattern = regexp.MustCompile(`\$\{secret:[^}]+\}`)
+	// invalidSecretKeyChars are not allowed in the keys of a Secret
+	invalidSecretKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+)
+
+// Placeholder replaces a secret which was moved into the key of a Secret
+func Placeholder(secretName, secretKey string) string {
+	return fmt.Sprintf("${secret:%s/%s}", secretName, secretKey)
+}
+
+// PlaceholderKeys returns the keys of the Secret which the placeholders in the
+// data refer to
+func PlaceholderKeys(data map[string]string, secretName string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, value := range data {
+		for _, p := range placeholderPattern.FindAllString(value, -1) {
+			ref := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(p, "${secret:"), "}"), "/", 2)
+			if len(ref) == 2 && ref[0] == secretName {
+				keys[ref[1]] = true
+			}
+		}
+	}
+	return keys
+}
+
+// MovedSecret is a secret which was moved from a configmap into a Secret
+type MovedSecret struct {
+	// Field is the configmap field which held the secret, e.g. `data[app.properties]`
+	Field string
+	// Location is where the secret was, e.g. `key "app.properties" line 3`
+	Location  string
+	InfoType  string
+	SecretKey string
+}
+
+// MoveSecrets replaces every secret found in the data of the configmap with
+// a placeholder which refers to the key of the Secret holding it. Only the
+// occurrence which was found is replaced, and in the last-applied-configuration
+// annotation only the same place of the same key. The configmap is modified in
+// place, and the values to store in the Secret are returned by key. Allowed
+// findings, findings which cannot be located in the raw value, e.g. in an
+// escaped string, and findings in binary data, labels or other annotations
+// are left as they are.
+func (a *Agent) MoveSecrets(ctx context.Context, configmap *corev1.ConfigMap, secretName string) (map[string]string, []MovedSecret, error) {
+	allowed, err := AnnotatedAllowedFindings(configmap.ObjectMeta)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowed = append(allowed, a.cfg.AllowedFindings...)
+
+	findings, err := a.inspect(ctx, segments(configmap.Data, nil))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the last findings of a line are replaced first, so that a replacement
+	// does not move the ones still to be made
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].segment, findings[j].segment
+		switch {
+		case a == nil || b == nil:
+			return b == nil && a != nil
+		case a.Key != b.Key:
+			return a.Key < b.Key
+		case a.Line != b.Line:
+			return a.Line > b.Line
+		case a.column != b.column:
+			return a.column > b.column
+		}
+		return findings[i].offset > findings[j].offset
+	})
+
+	values := make(map[string]string)
+	var moved []MovedSecret
+	for _, f := range findings {
+		seg := f.segment
+		if seg == nil {
+			continue
+		}
+		if a.allowed(configmap.ObjectMeta, allowed, seg.Key, f.InfoType, redact.Hash(f.Quote)) {
+			continue
+		}
+
+		secretKey := secretKeyFor(seg.Key, f.Quote)
+		placeholder := Placeholder(secretName, secretKey)
+		value, ok := replaceFinding(configmap.Data[seg.Key], seg, f.offset, f.Quote, placeholder)
+		if !ok {
+			continue
+		}
+		configmap.Data[seg.Key] = value
+		values[secretKey] = f.Quote
+		if lastApplied, ok := configmap.Annotations[lastAppliedAnnotation]; ok {
+			if patched, ok := replaceLastApplied(lastApplied, seg, f.offset, f.Quote, placeholder); ok {
+				configmap.Annotations[lastAppliedAnnotation] = patched
+			}
+		}
+
+		moved = append(moved, MovedSecret{
+			Field:     seg.Field,
+			Location:  fmt.Sprintf("key %q line %d", seg.Key, seg.Line),
+			InfoType:  f.InfoType,
+			SecretKey: secretKey,
+		})
+	}
+
+	sort.Slice(moved, func(i, j int) bool { return moved[i].SecretKey < moved[j].SecretKey })
+	return values, moved, nil
+}
+
+// secretKeyFor names the key of a moved secret after the configmap key and
+// the hash of the secret, so that the same secret always gets the same key
+func secretKeyFor(key, secret string) string {
+	return invalidSecretKeyChars.ReplaceAllString(key, "_") + "-" + redact.Hash(secret)[:8]
+}
+
+// replaceFinding replaces the quote found at offset in the text of the segment
+// in the raw value of its key. The occurrence is counted forward from the
+// column of the value, or backward from the end of the line for comments.
+// It returns false when the occurrence is not in the raw value.
+func replaceFinding(value string, seg *segment, offset int, quote, placeholder string) (string, bool) {
+	start, end, ok := lineSpan(value, seg.Line, seg.blockLines)
+	if !ok || offset+len(quote) > len(seg.Text) {
+		return value, false
+	}
+
+	at := -1
+	if seg.column > 0 {
+		from := start + seg.column - 1
+		if from > end || offset < seg.valueStart {
+			return value, false
+		}
+		if i := nthIndex(value[from:end], quote, strings.Count(seg.Text[seg.valueStart:offset], quote)); i >= 0 {
+			at = from + i
+		}
+	} else if i := nthLastIndex(value[start:end], quote, strings.Count(seg.Text[offset+len(quote):], quote)); i >= 0 {
+		at = start + i
+	}
+	if at < 0 {
+		return value, false
+	}
+	return value[:at] + placeholder + value[at+len(quote):], true
+}
+
+// replaceLastApplied replaces the quote in the value of the same key in the
+// data of the last applied manifest, at the same place as in the configmap
+func replaceLastApplied(lastApplied string, seg *segment, offset int, quote, placeholder string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(lastApplied))
+	decoder.UseNumber()
+	var manifest map[string]interface{}
+	if err := decoder.Decode(&manifest); err != nil {
+		return "", false
+	}
+	data, ok := manifest["data"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	value, ok := data[seg.Key].(string)
+	if !ok {
+		return "", false
+	}
+	if data[seg.Key], ok = replaceFinding(value, seg, offset, quote, placeholder); !ok {
+		return "", false
+	}
+
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(manifest); err != nil {
+		return "", false
+	}
+	if !strings.HasSuffix(lastApplied, "\n") {
+		return strings.TrimSuffix(b.String(), "\n"), true
+	}
+	return b.String(), true
+}
+
+// lineSpan returns the byte offsets of the start of the line, counting from
+// 1, and of the end of the extra lines below it
+func lineSpan(value string, line, extra int) (int, int, bool) {
+	start := 0
+	for i := 1; i < line; i++ {
+		n := strings.IndexByte(value[start:], '\n')
+		if n < 0 {
+			return 0, 0, false
+		}
+		start += n + 1
+	}
+	end := start
+	for i := 0; i <= extra; i++ {
+		n := strings.IndexByte(value[end:], '\n')
+		if n < 0 {
+			return start, len(value), true
+		}
+		if i < extra {
+			end += n + 1
+		} else {
+			end += n
+		}
+	}
+	return start, end, true
+}
+
+// nthIndex returns the index of the occurrence of sub in s after n others,
+// or -1
+func nthIndex(s, sub string, n int) int {
+	at := 0
+	for ; ; n-- {
+		i := strings.Index(s[at:], sub)
+		if i < 0 {
+			return -1
+		}
+		if n == 0 {
+			return at + i
+		}
+		at += i + len(sub)
+	}
+}
+
+// nthLastIndex returns the index of the occurrence of sub in s before n
+// others, or -1
+func nthLastIndex(s, sub string, n int) int {
+	for ; ; n-- {
+		i := strings.LastIndex(s, sub)
+		if i < 0 || n == 0 {
+			return i
+		}
+		s = s[:i]
+	}
+}
+
+// inPlaceholder reports whether the text between start and end is part of a
+// placeholder
+func inPlaceholder(spans [][]int, start, end int) bool {
+	for _, span := range spans {
+		if start < span[1] && end > span[0] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package configmap
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/satpol-pp/server/redact"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMain(m *testing.M) {
+	// the agents log every inspection with the global logger
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// quoteDetector finds every occurrence of its quotes
+type quoteDetector []string
+
+func (d quoteDetector) Inspect(ctx context.Context, req InspectRequest) ([]Finding, error) {
+	var findings []Finding
+	for _, quote := range d {
+		for at := 0; ; {
+			i := strings.Index(req.Text[at:], quote)
+			if i < 0 {
+				break
+			}
+			findings = append(findings, Finding{InfoType: "PASSWORD", Quote: quote, Likelihood: LikelihoodLikely, Offset: at + i})
+			at += i + len(quote)
+		}
+	}
+	return findings, nil
+}
+
+func (quoteDetector) Close() error { return nil }
+
+func newMoveAgent(t *testing.T, cfg AgentConfig, quotes ...string) *Agent {
+	t.Helper()
+	a, err := New(&cfg, quoteDetector(quotes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestMoveSecrets(t *testing.T) {
+	const secret = "hunter2!"
+	placeholder := Placeholder("app-satpolpp", secretKeyFor("app.properties", secret))
+	jsonPlaceholder := Placeholder("app-satpolpp", secretKeyFor("app.json", secret))
+
+	tests := []struct {
+		name  string
+		cfg   AgentConfig
+		data  map[string]string
+		want  map[string]string
+		moved int
+	}{
+		{
+			name:  "same secret twice in a key",
+			data:  map[string]string{"app.properties": "password=hunter2!\nbackup_password=hunter2!\nuser=admin\n"},
+			want:  map[string]string{"app.properties": "password=" + placeholder + "\nbackup_password=" + placeholder + "\nuser=admin\n"},
+			moved: 2,
+		},
+		{
+			name:  "same secret twice on a line",
+			data:  map[string]string{"app.json": `{"a": "hunter2!", "b": "hunter2!"}`},
+			want:  map[string]string{"app.json": `{"a": "` + jsonPlaceholder + `", "b": "` + jsonPlaceholder + `"}`},
+			moved: 2,
+		},
+		{
+			name:  "value and comment on a line",
+			data:  map[string]string{"app.properties": "password=hunter2!\n# old password=hunter2!\n"},
+			want:  map[string]string{"app.properties": "password=" + placeholder + "\n# old password=" + placeholder + "\n"},
+			moved: 2,
+		},
+		{
+			name: "allowed finding",
+			cfg: AgentConfig{AllowedFindings: []AllowedFinding{
+				{Key: "app.properties", Hash: redact.Hash(secret)},
+			}},
+			data: map[string]string{"app.properties": "password=hunter2!\n"},
+			want: map[string]string{"app.properties": "password=hunter2!\n"},
+		},
+		{
+			name: "moved secret",
+			data: map[string]string{"app.properties": "password=" + placeholder + "\n"},
+			want: map[string]string{"app.properties": "password=" + placeholder + "\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newMoveAgent(t, tt.cfg, secret)
+			configmap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}, Data: tt.data}
+			values, moved, err := a.MoveSecrets(context.Background(), configmap, "app-satpolpp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(configmap.Data, tt.want) {
+				t.Errorf("data is %q, want %q", configmap.Data, tt.want)
+			}
+			if len(moved) != tt.moved {
+				t.Errorf("moved %d secrets, want %d", len(moved), tt.moved)
+			}
+			for key, value := range values {
+				if value != secret {
+					t.Errorf("key %s holds %q, want the secret", key, value)
+				}
+			}
+			if tt.moved > 0 && len(values) != 1 {
+				t.Errorf("got %d values, want the secret once", len(values))
+			}
+		})
+	}
+}
+
+func TestMoveSecretsLastApplied(t *testing.T) {
+	const secret = "hunter2!"
+	placeholder := Placeholder("app-satpolpp", secretKeyFor("app.properties", secret))
+
+	lastApplied := func(data, note string) string {
+		b, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":        "app",
+				"annotations": map[string]string{"note": note},
+			},
+			"data": map[string]string{"app.properties": data},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b) + "\n"
+	}
+
+	tests := []struct {
+		name        string
+		lastApplied string
+		want        string
+	}{
+		{
+			name:        "same data",
+			lastApplied: lastApplied("password=hunter2!\n", "hunter2!"),
+			// the secret is only replaced in the data of the manifest
+			want: lastApplied("password="+placeholder+"\n", "hunter2!"),
+		},
+		{
+			name:        "older data",
+			lastApplied: lastApplied("user=admin\n", "hunter2!"),
+			want:        lastApplied("user=admin\n", "hunter2!"),
+		},
+		{
+			name:        "not json",
+			lastApplied: "password=hunter2!",
+			want:        "password=hunter2!",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newMoveAgent(t, AgentConfig{}, secret)
+			configmap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app",
+					Namespace:   "default",
+					Annotations: map[string]string{lastAppliedAnnotation: tt.lastApplied},
+				},
+				Data: map[string]string{"app.properties": "password=hunter2!\n"},
+			}
+			if _, _, err := a.MoveSecrets(context.Background(), configmap, "app-satpolpp"); err != nil {
+				t.Fatal(err)
+			}
+			if got := configmap.Annotations[lastAppliedAnnotation]; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholderKeys(t *testing.T) {
+	data := map[string]string{
+		"a": "password=${secret:app-satpolpp/a-1}\ntoken=${secret:app-satpolpp/a-2}",
+		"b": "${secret:other-satpolpp/b-1} ${secret:app-satpolpp}",
+	}
+	want := map[string]bool{"a-1": true, "a-2": true}
+	if got := PlaceholderKeys(data, "app-satpolpp"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
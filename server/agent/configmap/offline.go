@@ -0,0 +1,223 @@
+package configmap
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// pattern finds one kind of secret. When the expression has a capturing group
+// the first group is the secret, otherwise the whole match is.
+type pattern struct {
+	infoType string
+	re       *regexp.Regexp
+	// likelihood decides how likely the secret is real
+	likelihood func(secret string) Likelihood
+}
+
+var offlinePatterns = []pattern{
+	{
+		infoType:   "AWS_CREDENTIALS",
+		re:         regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "AWS_CREDENTIALS",
+		re:         regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`),
+		likelihood: byEntropy(4.0),
+	},
+	{
+		infoType:   "GCP_CREDENTIALS",
+		re:         regexp.MustCompile(`"type"\s*:\s*"service_account"`),
+		likelihood: fixed(LikelihoodLikely),
+	},
+	{
+		infoType:   "GCP_CREDENTIALS",
+		re:         regexp.MustCompile(`"private_key_id"\s*:\s*"([a-f0-9]{40})"`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "GCP_API_KEY",
+		re:         regexp.MustCompile(`\b(AIza[0-9A-Za-z_-]{35})\b`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "JSON_WEB_TOKEN",
+		re:         regexp.MustCompile(`\b(eyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,})`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "BASIC_AUTH_HEADER",
+		re:         regexp.MustCompile(`(?i)authorization["']?\s*[:=]\s*["']?basic\s+([A-Za-z0-9+/]{8,}={0,2})`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "AUTH_TOKEN",
+		re:         regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9._~+/-]{20,}=*)`),
+		likelihood: byEntropy(3.5),
+	},
+	{
+		infoType:   "ENCRYPTION_KEY",
+		re:         regexp.MustCompile(`-----BEGIN (?:[A-Z]+ )*PRIVATE KEY-----`),
+		likelihood: fixed(LikelihoodVeryLikely),
+	},
+	{
+		infoType:   "WEAK_PASSWORD_HASH",
+		re:         regexp.MustCompile(`(\$(?:1|apr1)\$[./0-9A-Za-z]{1,8}\$[./0-9A-Za-z]{22})`),
+		likelihood: fixed(LikelihoodLikely),
+	},
+	{
+		infoType:   "PASSWORD",
+		re:         regexp.MustCompile(`(?i)(?:password|passwd|pwd|secret|api_?key|access_?token)["']?\s*[:=]\s*["']?([^\s"',;]{6,})`),
+		likelihood: byEntropy(3.0),
+	},
+}
+
+// OfflineDetector finds secrets with regular expressions and Shannon entropy.
+// It needs no network access, so it can be used in air-gapped clusters and
+// for local testing, at the cost of being less accurate than Cloud DLP.
+type OfflineDetector struct{}
+
+// NewOfflineDetector ...
+func NewOfflineDetector() *OfflineDetector {
+	return &OfflineDetector{}
+}
+
+// SupportsInfoType reports whether the offline detector can find the info type
+func SupportsInfoType(infoType string) bool {
+	for _, p := range offlinePatterns {
+		if p.infoType == infoType {
+			return true
+		}
+	}
+	return false
+}
+
+// Inspect ...
+func (d *OfflineDetector) Inspect(ctx context.Context, req InspectRequest) ([]Finding, error) {
+	wanted := make(map[string]bool, len(req.InfoTypes))
+	for _, infoType := range req.InfoTypes {
+		wanted[infoType] = true
+	}
+
+	var findings []Finding
+	for _, p := range offlinePatterns {
+		if !wanted[p.infoType] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, match := range p.re.FindAllStringSubmatchIndex(req.Text, -1) {
+			start, end := match[0], match[1]
+			if len(match) > 2 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			secret := req.Text[start:end]
+			findings = append(findings, Finding{
+				InfoType:   p.infoType,
+				Quote:      secret,
+				Likelihood: p.likelihood(secret),
+				Offset:     start,
+			})
+		}
+	}
+
+	for _, t := range req.CustomInfoTypes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		expr := t.Regex
+		if expr == "" {
+			expr = dictionaryPattern(t.Dictionary)
+		}
+		re, err := compileCached(expr)
+		if err != nil {
+			return nil, fmt.Errorf("custom info type %s: %w", t.Name, err)
+		}
+		for _, match := range re.FindAllStringIndex(req.Text, -1) {
+			findings = append(findings, Finding{
+				InfoType:   t.Name,
+				Quote:      req.Text[match[0]:match[1]],
+				Likelihood: t.likelihood(),
+				Offset:     match[0],
+			})
+		}
+	}
+
+	return filterFindings(findings, req), nil
+}
+
+// filterFindings drops the findings which are less likely than the minimum or
+// match an exclusion rule, like Cloud DLP does
+func filterFindings(findings []Finding, req InspectRequest) []Finding {
+	filtered := findings[:0]
+	for _, f := range findings {
+		if f.Likelihood < req.MinLikelihood || excluded(f, req.ExclusionRules) {
+			continue
+		}
+		filtered = append(filtered, f)
+	}
+	return filtered
+}
+
+func excluded(f Finding, rules []ExclusionRule) bool {
+	for _, r := range rules {
+		if r.excludes(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close ...
+func (d *OfflineDetector) Close() error {
+	return nil
+}
+
+func fixed(l Likelihood) func(string) Likelihood {
+	return func(string) Likelihood {
+		return l
+	}
+}
+
+// byEntropy rates a secret by its Shannon entropy, so that random looking
+// values are more likely to be real than words such as `changeme`.
+func byEntropy(threshold float64) func(string) Likelihood {
+	return func(secret string) Likelihood {
+		switch e := entropy(secret); {
+		case e >= threshold+0.5:
+			return LikelihoodVeryLikely
+		case e >= threshold:
+			return LikelihoodLikely
+		case e >= threshold-1:
+			return LikelihoodPossible
+		default:
+			return LikelihoodUnlikely
+		}
+	}
+}
+
+// entropy returns the Shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	counts := make(map[rune]int)
+	var n int
+	for _, r := range s {
+		counts[r]++
+		n++
+	}
+
+	var e float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
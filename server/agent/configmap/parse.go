@@ -0,0 +1,337 @@
+package configmap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// segment is a single value of a configmap key, inspected together with its
+// name so that the detector can use it as context, e.g. `db_password: ...`
+type segment struct {
+	// Field is the configmap field holding the value, e.g. `data[app.yaml]`
+	Field string
+	// Key is the configmap key, or the name of the container
+	Key string
+	// Line is the line of the value inside the key, starting at 1
+	Line int
+	// Location describes where a value outside of the configmap data is, e.g.
+	// `container app env DB_PASSWORD`
+	Location string
+	// Text is the text inspected by the detector
+	Text string
+
+	// blockLines is the number of lines of a YAML block scalar below Line
+	blockLines int
+	// column is where the value starts on Line in the raw text, counting from
+	// 1, and valueStart where it starts in Text. Comments have no column, as
+	// they end their line instead.
+	column     int
+	valueStart int
+}
+
+// annotationPrefix is the prefix of the annotations of satpol-pp
+const annotationPrefix = "satpolpp.imrenagi.com/"
+
+// assignmentPattern matches `key=value` and `key: value` lines, and the
+// `export KEY=value` lines of .env files. The key has to be an identifier,
+// so that base64 such as the body of a PEM block is not split.
+var assignmentPattern = regexp.MustCompile(`^(?:export\s+)?([A-Za-z_][A-Za-z0-9_.\-]*)\s*([=:])\s*(.*)$`)
+
+// lineFormats are the file extensions of `key=value` formats
+var lineFormats = map[string]bool{
+	".properties": true,
+	".env":        true,
+	".ini":        true,
+	".cfg":        true,
+	".conf":       true,
+}
+
+// segments splits the data and the text binary data of the configmap into the
+// values to inspect. Keys are visited in order so that the text sent to the
+// detector is stable.
+func segments(data map[string]string, binaryData map[string][]byte) []segment {
+	var segs []segment
+	for _, key := range sortedKeys(data) {
+		segs = append(segs, parseValue(fmt.Sprintf("data[%s]", key), key, data[key])...)
+	}
+	for _, key := range sortedBinaryKeys(binaryData) {
+		value := binaryData[key]
+		if !isText(value) {
+			continue
+		}
+		segs = append(segs, parseValue(fmt.Sprintf("binaryData[%s]", key), key, string(value))...)
+	}
+	return segs
+}
+
+// metadataSegments returns the labels and annotations of an object. JSON
+// annotations, such as the manifest stored by `kubectl apply` in
+// last-applied-configuration, are decoded and flattened like configmap values.
+// The annotations of satpol-pp itself are skipped.
+func metadataSegments(meta metav1.ObjectMeta) []segment {
+	var segs []segment
+	for _, key := range sortedKeys(meta.Labels) {
+		segs = append(segs, segment{
+			Field:    fmt.Sprintf("metadata.labels[%s]", key),
+			Key:      key,
+			Line:     1,
+			Location: fmt.Sprintf("label %s", key),
+			Text:     fmt.Sprintf("%s: %s", key, meta.Labels[key]),
+		})
+	}
+	for _, key := range sortedKeys(meta.Annotations) {
+		if strings.HasPrefix(key, annotationPrefix) {
+			continue
+		}
+		value := meta.Annotations[key]
+		structured := looksStructured(value)
+		multiline := strings.Contains(strings.TrimRight(value, "\n"), "\n")
+		for _, seg := range parseValue(fmt.Sprintf("metadata.annotations[%s]", key), key, value) {
+			seg.Location = fmt.Sprintf("annotation %s", key)
+			switch {
+			case structured:
+				// name the field of the decoded manifest, e.g. `data.password`
+				seg.Location += " " + strings.SplitN(seg.Text, ": ", 2)[0]
+			case multiline:
+				seg.Location += fmt.Sprintf(" line %d", seg.Line)
+			}
+			segs = append(segs, seg)
+		}
+	}
+	return segs
+}
+
+// parseValue splits a value by its format. JSON and YAML values are flattened
+// into `path: value` leaves, `key=value` formats such as .properties, .env and
+// INI are split by line, and a single line is named after the configmap key.
+func parseValue(field, key, value string) []segment {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if !strings.Contains(strings.TrimRight(value, "\n"), "\n") && !looksStructured(value) {
+		return []segment{{
+			Field:      field,
+			Key:        key,
+			Line:       1,
+			Text:       fmt.Sprintf("%s: %s", key, strings.TrimSpace(value)),
+			column:     len(value) - len(strings.TrimLeft(value, " \t")) + 1,
+			valueStart: len(key) + 2,
+		}}
+	}
+
+	ext := strings.ToLower(path.Ext(key))
+	if ext == ".json" || ext == ".yaml" || ext == ".yml" || (!lineFormats[ext] && looksStructured(value)) {
+		if segs, err := parseStructured(field, key, value); err == nil {
+			return segs
+		}
+	}
+	return parseLines(field, key, value)
+}
+
+func looksStructured(value string) bool {
+	trimmed := strings.TrimSpace(value)
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
+
+// parseStructured flattens JSON or YAML, which may have several documents.
+// YAML comments are inspected too, as commented out credentials are a common
+// leak.
+func parseStructured(field, key, value string) ([]segment, error) {
+	var segs []segment
+	decoder := yaml.NewDecoder(strings.NewReader(value))
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		segs = flatten(segs, field, key, "", &doc)
+	}
+	return append(segs, yamlComments(field, key, value, segs)...), nil
+}
+
+// yamlComments returns the comments which take a whole line, except for the
+// lines of block scalars which were already inspected as values. Comments at
+// the end of a line are returned by flatten.
+func yamlComments(field, key, value string, values []segment) []segment {
+	inBlock := make(map[int]bool)
+	for _, seg := range values {
+		for i := 1; i <= seg.blockLines; i++ {
+			inBlock[seg.Line+i] = true
+		}
+	}
+
+	var segs []segment
+	for i, text := range strings.Split(value, "\n") {
+		line := i + 1
+		if text = strings.TrimSpace(text); strings.HasPrefix(text, "#") && !inBlock[line] {
+			if seg, ok := commentSegment(field, key, line, text, ""); ok {
+				segs = append(segs, seg)
+			}
+		}
+	}
+	return segs
+}
+
+func flatten(segs []segment, field, key, prefix string, node *yaml.Node) []segment {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			segs = flatten(segs, field, key, prefix, n)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			segs = appendLineComment(segs, field, key, node.Content[i])
+			segs = flatten(segs, field, key, name, node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			segs = flatten(segs, field, key, fmt.Sprintf("%s[%d]", prefix, i), n)
+		}
+	case yaml.ScalarNode:
+		name := prefix
+		if name == "" {
+			name = key
+		}
+		seg := segment{
+			Field:      field,
+			Key:        key,
+			Line:       node.Line,
+			Text:       fmt.Sprintf("%s: %s", name, node.Value),
+			column:     node.Column,
+			valueStart: len(name) + 2,
+		}
+		if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+			seg.blockLines = strings.Count(strings.TrimRight(node.Value, "\n"), "\n") + 1
+		}
+		segs = appendLineComment(append(segs, seg), field, key, node)
+	}
+	return segs
+}
+
+// appendLineComment adds the comment at the end of the line of the node
+func appendLineComment(segs []segment, field, key string, node *yaml.Node) []segment {
+	if node.LineComment == "" {
+		return segs
+	}
+	if seg, ok := commentSegment(field, key, node.Line, node.LineComment, ""); ok {
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// parseLines splits `key=value` lines. INI sections prefix the keys, comments
+// are inspected without their marker, e.g. `# password=...` as
+// `password = ...`, and other lines are inspected as they are.
+func parseLines(field, key, value string) []segment {
+	var segs []segment
+	var section string
+	scanner := bufio.NewScanner(strings.NewReader(value))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(value)+1)
+	for line := 1; scanner.Scan(); line++ {
+		raw := scanner.Text()
+		text := strings.TrimSpace(raw)
+		switch {
+		case text == "":
+			continue
+		case strings.ContainsAny(text[:1], commentMarkers):
+			if seg, ok := commentSegment(field, key, line, text, section); ok {
+				segs = append(segs, seg)
+			}
+			continue
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		normalized, valueStart, rawValueStart := assignment(text, section)
+		indent := len(raw) - len(strings.TrimLeft(raw, " \t"))
+		segs = append(segs, segment{
+			Field:      field,
+			Key:        key,
+			Line:       line,
+			Text:       normalized,
+			column:     indent + rawValueStart + 1,
+			valueStart: valueStart,
+		})
+	}
+	return segs
+}
+
+// commentMarkers start the comments of the `key=value` formats and of YAML
+const commentMarkers = "#;!"
+
+// commentSegment returns the text of a comment without its markers, or false
+// when the comment is empty
+func commentSegment(field, key string, line int, comment, section string) (segment, bool) {
+	text := strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(comment), commentMarkers))
+	if text == "" {
+		return segment{}, false
+	}
+	text, _, _ = assignment(text, section)
+	return segment{Field: field, Key: key, Line: line, Text: text}, true
+}
+
+// assignment normalizes a `key=value` line to `key = value`, where the key is
+// prefixed by its INI section, and returns where the value starts in the
+// normalized and in the given line. Other lines, such as base64 ending with
+// `=` padding or URLs, are returned as they are.
+func assignment(text, section string) (string, int, int) {
+	m := assignmentPattern.FindStringSubmatchIndex(text)
+	if m == nil {
+		return text, 0, 0
+	}
+	value := text[m[6]:m[7]]
+	if strings.HasPrefix(value, "//") || (text[m[4]:m[5]] == "=" && strings.Trim(value, "=") == "") {
+		return text, 0, 0
+	}
+	name := text[m[2]:m[3]]
+	if section != "" {
+		name = section + "." + name
+	}
+	return fmt.Sprintf("%s = %s", name, strings.Trim(value, `"'`)), len(name) + 3, m[6]
+}
+
+// isText reports whether binary data is text worth inspecting
+func isText(b []byte) bool {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedBinaryKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -6,27 +6,94 @@ import (
 	"strings"
 
 	"github.com/imrenagi/satpol-pp/server/agent"
-	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// AgentConfig is the deployment section of the policy file
 type AgentConfig struct {
-	ImageRegistries []string
+	ImageRegistries []string `json:"imageRegistries,omitempty"`
+
+	// RequireLivenessProbe and RequireReadinessProbe default to true when
+	// they are not set.
+	RequireLivenessProbe  *bool `json:"requireLivenessProbe,omitempty"`
+	RequireReadinessProbe *bool `json:"requireReadinessProbe,omitempty"`
+
+	// CheckInitContainerProbes also requires probes on init containers. It is
+	// off by default because only restartable (sidecar) init containers may
+	// have probes. Ephemeral containers can never have probes and are skipped.
+	CheckInitContainerProbes *bool `json:"checkInitContainerProbes,omitempty"`
+
+	// ProbeExemptKinds are the workload kinds which need no probes. Jobs and
+	// CronJobs run to completion, so they are exempted when this is not set.
+	ProbeExemptKinds []string `json:"probeExemptKinds,omitempty"`
 }
 
-func Init(cfg *AgentConfig) error {
-	cfg.ImageRegistries = []string{
-		"gcr.io/imre-demo",
-		"docker.io/imrenagi",
+// DefaultProbeExemptKinds are used when ProbeExemptKinds is not set
+var DefaultProbeExemptKinds = []string{KindJob, KindCronJob}
+
+// Merge returns a copy of c extended by o. Registries of both are allowed,
+// while the probe requirements and probe exempt kinds of o win when they are set.
+func (c AgentConfig) Merge(o AgentConfig) AgentConfig {
+	merged := c
+	merged.ImageRegistries = agent.MergeStrings(c.ImageRegistries, o.ImageRegistries)
+	if o.RequireLivenessProbe != nil {
+		merged.RequireLivenessProbe = o.RequireLivenessProbe
+	}
+	if o.RequireReadinessProbe != nil {
+		merged.RequireReadinessProbe = o.RequireReadinessProbe
+	}
+	if o.CheckInitContainerProbes != nil {
+		merged.CheckInitContainerProbes = o.CheckInitContainerProbes
+	}
+	if o.ProbeExemptKinds != nil {
+		merged.ProbeExemptKinds = o.ProbeExemptKinds
 	}
+	return merged
+}
 
-	return nil
+// Validate returns all the problems found in the config. Each error message
+// starts with the name of the offending field.
+func (c AgentConfig) Validate() []error {
+	var errs []error
+	if len(c.ImageRegistries) == 0 {
+		errs = append(errs, fmt.Errorf("imageRegistries: at least one registry must be allowed"))
+	}
+	for i, registry := range c.ImageRegistries {
+		switch {
+		case strings.TrimSpace(registry) == "":
+			errs = append(errs, fmt.Errorf("imageRegistries[%d]: must not be empty", i))
+		case strings.Contains(registry, "://"):
+			errs = append(errs, fmt.Errorf("imageRegistries[%d]: %q must not contain a url scheme", i, registry))
+		default:
+			if _, err := ParseRegistryPattern(registry); err != nil {
+				errs = append(errs, fmt.Errorf("imageRegistries[%d]: %s", i, err))
+			}
+		}
+	}
+	for i, kind := range c.ProbeExemptKinds {
+		if !knownKind(kind) {
+			errs = append(errs, fmt.Errorf("probeExemptKinds[%d]: %q is not a workload kind", i, kind))
+		}
+	}
+	return errs
+}
+
+func knownKind(kind string) bool {
+	for _, k := range WorkloadKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
 }
 
 // Agent is the top level structure holding all the
-// configurations for the agent which validates the deployment
+// configurations for the agent which validates the deployment.
+// It is safe for concurrent use.
 type Agent struct {
-	cfg *AgentConfig
+	cfg        *AgentConfig
+	registries []RegistryPattern
 }
 
 // New creates a new instance of Agent by parsing all the Kubernetes annotations.
@@ -34,55 +101,177 @@ func New(cfg *AgentConfig) (*Agent, error) {
 	agent := &Agent{
 		cfg: cfg,
 	}
+	for _, registry := range cfg.ImageRegistries {
+		p, err := ParseRegistryPattern(registry)
+		if err != nil {
+			return nil, err
+		}
+		agent.registries = append(agent.registries, p)
+	}
 	return agent, nil
 }
 
-// ValidRegistry validate whether a pod has identified/valid docker registry
-func (a *Agent) ValidRegistry(pod corev1.PodSpec) error {
-	for _, container := range pod.Containers {
+// ValidRegistry validate whether a pod has identified/valid docker registry.
+// Init and ephemeral containers are checked as well. Fields of the violations
+// are relative to the pod spec.
+func (a *Agent) ValidRegistry(pod corev1.PodSpec) agent.Violations {
+	var violations agent.Violations
+	for _, container := range podContainers(pod) {
+		violation := agent.Violation{
+			RuleID:    agent.RuleRegistry,
+			Container: container.Name,
+			Field:     container.Field + ".image",
+		}
+
+		img, err := ParseImage(container.Image)
+		if err != nil {
+			violation.Message = fmt.Sprintf("%s %s has invalid image %q: %s", container.Kind, container.Name, container.Image, err)
+			violations = append(violations, violation)
+			continue
+		}
+
 		var valid bool
-		for _, registry := range a.cfg.ImageRegistries {
-			if strings.Contains(container.Image, registry) {
+		for _, registry := range a.registries {
+			if registry.Match(img) {
 				valid = true
 				break
 			}
 		}
 		if !valid {
-			return fmt.Errorf("container %s used unidentified registry %s", container.Name, container.Image)
+			violation.Message = fmt.Sprintf("%s %s used unidentified registry %s (resolved to %s)", container.Kind, container.Name, container.Image, img.Name())
+			violations = append(violations, violation)
 		}
 	}
-	return nil
+	return violations
 }
 
-// ValidProbe ...
-func (a *Agent) ValidProbe(pod corev1.PodSpec) error {
-
-	for _, container := range pod.Containers {
-		if container.LivenessProbe == nil {
-			return fmt.Errorf("container %s has no liveness probe configured", container.Name)
+// ProbesRequired reports whether the pods of the workload kind must have probes
+func (a *Agent) ProbesRequired(kind string) bool {
+	exempt := a.cfg.ProbeExemptKinds
+	if exempt == nil {
+		exempt = DefaultProbeExemptKinds
+	}
+	for _, k := range exempt {
+		if k == kind {
+			return false
 		}
-		if container.LivenessProbe.TCPSocket == nil &&
-			container.LivenessProbe.Exec == nil &&
-			container.LivenessProbe.HTTPGet == nil {
-			return fmt.Errorf("none of tcp socket, exec, and httpGet is configured for liveness probe in container %s", container.Name)
+	}
+	return true
+}
+
+// ValidProbe ...
+func (a *Agent) ValidProbe(pod corev1.PodSpec) agent.Violations {
+	var violations agent.Violations
+	for _, container := range podContainers(pod) {
+		switch {
+		case container.Kind == initContainer && !enabled(a.cfg.CheckInitContainerProbes):
+			continue
+		case container.Kind == ephemeralContainer:
+			continue
 		}
 
-		if container.ReadinessProbe == nil {
-			return fmt.Errorf("container %s has no readiness probe configured", container.Name)
+		if required(a.cfg.RequireLivenessProbe) {
+			if msg := validProbe(container.Name, "liveness", container.LivenessProbe); msg != "" {
+				violations = append(violations, agent.Violation{
+					RuleID:    agent.RuleProbe,
+					Container: container.Name,
+					Field:     container.Field + ".livenessProbe",
+					Message:   msg,
+				})
+			}
 		}
-		if container.ReadinessProbe.TCPSocket == nil &&
-			container.ReadinessProbe.Exec == nil &&
-			container.ReadinessProbe.HTTPGet == nil {
-			return fmt.Errorf("none of tcp socket, exec, and httpGet is configured for readiness probe in container %s", container.Name)
+		if required(a.cfg.RequireReadinessProbe) {
+			if msg := validProbe(container.Name, "readiness", container.ReadinessProbe); msg != "" {
+				violations = append(violations, agent.Violation{
+					RuleID:    agent.RuleProbe,
+					Container: container.Name,
+					Field:     container.Field + ".readinessProbe",
+					Message:   msg,
+				})
+			}
 		}
 	}
-	return nil
+	return violations
+}
+
+func validProbe(container, kind string, probe *corev1.Probe) string {
+	if probe == nil {
+		return fmt.Sprintf("container %s has no %s probe configured", container, kind)
+	}
+	if probe.TCPSocket == nil &&
+		probe.Exec == nil &&
+		probe.HTTPGet == nil {
+		return fmt.Sprintf("none of tcp socket, exec, and httpGet is configured for %s probe in container %s", kind, container)
+	}
+	return ""
+}
+
+const (
+	regularContainer   = "container"
+	initContainer      = "init container"
+	ephemeralContainer = "ephemeral container"
+)
+
+// podContainer is the common part of regular, init and ephemeral containers
+type podContainer struct {
+	Kind string
+	// Field is the path of the container inside the pod spec
+	Field          string
+	Name           string
+	Image          string
+	LivenessProbe  *corev1.Probe
+	ReadinessProbe *corev1.Probe
+}
+
+func podContainers(pod corev1.PodSpec) []podContainer {
+	var containers []podContainer
+	for i, c := range pod.Containers {
+		containers = append(containers, podContainer{
+			Kind:           regularContainer,
+			Field:          fmt.Sprintf("containers[%d]", i),
+			Name:           c.Name,
+			Image:          c.Image,
+			LivenessProbe:  c.LivenessProbe,
+			ReadinessProbe: c.ReadinessProbe,
+		})
+	}
+	for i, c := range pod.InitContainers {
+		containers = append(containers, podContainer{
+			Kind:           initContainer,
+			Field:          fmt.Sprintf("initContainers[%d]", i),
+			Name:           c.Name,
+			Image:          c.Image,
+			LivenessProbe:  c.LivenessProbe,
+			ReadinessProbe: c.ReadinessProbe,
+		})
+	}
+	for i, c := range pod.EphemeralContainers {
+		containers = append(containers, podContainer{
+			Kind:  ephemeralContainer,
+			Field: fmt.Sprintf("ephemeralContainers[%d]", i),
+			Name:  c.Name,
+			Image: c.Image,
+		})
+	}
+	return containers
+}
+
+// required reports whether an optional requirement is enabled. Requirements
+// are enabled unless they are explicitly turned off.
+func required(b *bool) bool {
+	return b == nil || *b
+}
+
+// enabled reports whether an optional feature is enabled. Features are
+// disabled unless they are explicitly turned on.
+func enabled(b *bool) bool {
+	return b != nil && *b
 }
 
-// ShouldIgnore ignore this deployment from validation if the deployment has
+// ShouldIgnore ignore this workload from validation if the workload has
 // additional annotations
-func ShouldIgnore(deployment appsv1.Deployment) (bool, error) {
-	raw, ok := deployment.Annotations[agent.AnnotationIgnoreCheck]
+func ShouldIgnore(obj metav1.Object) (bool, error) {
+	raw, ok := obj.GetAnnotations()[agent.AnnotationIgnoreCheck]
 	if !ok {
 		return false, nil
 	}
@@ -0,0 +1,174 @@
+package deployment
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	dockerHub        = "docker.io"
+	dockerHubLibrary = "library"
+)
+
+var (
+	hostPattern      = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	componentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagPattern       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+
+	// dockerHubAliases are the other host names of Docker Hub
+	dockerHubAliases = []string{"index.docker.io", "registry-1.docker.io"}
+)
+
+// Image is a parsed container image reference
+type Image struct {
+	// Registry is the host of the registry, including the port if any
+	Registry string
+	// Repository is the path of the image inside the registry
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImage parses an image reference the same way the container runtime
+// does. An image without registry comes from Docker Hub, and a Docker Hub
+// image without namespace is an official `library` image, so `nginx` is
+// `docker.io/library/nginx`.
+func ParseImage(s string) (Image, error) {
+	var img Image
+	if s == "" {
+		return img, fmt.Errorf("image reference is empty")
+	}
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, img.Digest = name[:i], name[i+1:]
+		if !digestPattern.MatchString(img.Digest) {
+			return img, fmt.Errorf("invalid digest %q", img.Digest)
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, img.Tag = name[:i], name[i+1:]
+		if !tagPattern.MatchString(img.Tag) {
+			return img, fmt.Errorf("invalid tag %q", img.Tag)
+		}
+	}
+
+	img.Registry, img.Repository = splitHost(name)
+	if !hostPattern.MatchString(img.Registry) {
+		return img, fmt.Errorf("invalid registry host %q", img.Registry)
+	}
+	if img.Registry == dockerHub && !strings.Contains(img.Repository, "/") {
+		img.Repository = dockerHubLibrary + "/" + img.Repository
+	}
+	for _, component := range strings.Split(img.Repository, "/") {
+		if !componentPattern.MatchString(component) {
+			return img, fmt.Errorf("invalid repository %q", img.Repository)
+		}
+	}
+	return img, nil
+}
+
+// Name returns the registry and repository of the image
+func (i Image) Name() string {
+	return i.Registry + "/" + i.Repository
+}
+
+// String returns the normalized image reference
+func (i Image) String() string {
+	s := i.Name()
+	if i.Tag != "" {
+		s += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		s += "@" + i.Digest
+	}
+	return s
+}
+
+// RegistryPattern is an allowed registry from the policy. It is either
+//
+//   - a registry host, e.g. `gcr.io`, which allows every image of the host,
+//   - a repository, e.g. `gcr.io/imre-demo`, which allows the repository and
+//     everything below it,
+//   - a repository ending with `/*`, e.g. `gcr.io/imre-demo/*`, which allows
+//     everything below the repository but not the repository itself, or
+//   - a shell pattern, e.g. `gcr.io/team-*/app`, matched against the whole
+//     repository.
+//
+// The host always has to be equal. Official Docker Hub images are allowed with
+// `docker.io/library/<name>`.
+type RegistryPattern struct {
+	Registry   string
+	Repository string
+}
+
+// ParseRegistryPattern parses an allowed registry from the policy
+func ParseRegistryPattern(s string) (RegistryPattern, error) {
+	var p RegistryPattern
+	host, repository := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		host, repository = s[:i], strings.TrimSuffix(s[i+1:], "/")
+	}
+	if !isHost(host) || !hostPattern.MatchString(host) {
+		return p, fmt.Errorf("%q must start with a registry host such as docker.io", s)
+	}
+	if _, err := path.Match(repository, ""); err != nil {
+		return p, fmt.Errorf("invalid repository pattern %q", repository)
+	}
+
+	p.Registry, p.Repository = normalizeHost(host), repository
+	return p, nil
+}
+
+// Match reports whether the image is allowed by the pattern
+func (p RegistryPattern) Match(img Image) bool {
+	if p.Registry != img.Registry {
+		return false
+	}
+
+	switch {
+	case p.Repository == "":
+		return true
+	case strings.HasSuffix(p.Repository, "/*"):
+		base := strings.TrimSuffix(p.Repository, "/*")
+		n := strings.Count(base, "/") + 1
+		components := strings.SplitN(img.Repository, "/", n+1)
+		if len(components) <= n {
+			return false
+		}
+		ok, _ := path.Match(base, strings.Join(components[:n], "/"))
+		return ok
+	case strings.ContainsAny(p.Repository, "*?["):
+		ok, _ := path.Match(p.Repository, img.Repository)
+		return ok
+	default:
+		return img.Repository == p.Repository || strings.HasPrefix(img.Repository, p.Repository+"/")
+	}
+}
+
+// splitHost splits the registry host from the repository. The first component
+// is only a host when it looks like one, otherwise the image is on Docker Hub.
+func splitHost(name string) (host, repository string) {
+	i := strings.Index(name, "/")
+	if i < 0 || !isHost(name[:i]) {
+		return dockerHub, name
+	}
+	return normalizeHost(name[:i]), name[i+1:]
+}
+
+func isHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+func normalizeHost(host string) string {
+	for _, alias := range dockerHubAliases {
+		if host == alias {
+			return dockerHub
+		}
+	}
+	return host
+}
@@ -0,0 +1,137 @@
+package deployment
+
+import "testing"
+
+const digest = "sha256:6b5a1c1f3bd7e1a1d1b4d0a8e3c1b9a4f2d6e8c0b1a3f5e7d9c2b4a6e8f0c1d3"
+
+func TestParseImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  Image
+	}{
+		// Docker Hub
+		{"nginx", Image{Registry: "docker.io", Repository: "library/nginx"}},
+		{"nginx:1.19", Image{Registry: "docker.io", Repository: "library/nginx", Tag: "1.19"}},
+		{"imrenagi/app", Image{Registry: "docker.io", Repository: "imrenagi/app"}},
+		{"docker.io/nginx", Image{Registry: "docker.io", Repository: "library/nginx"}},
+		{"index.docker.io/nginx", Image{Registry: "docker.io", Repository: "library/nginx"}},
+		{"registry-1.docker.io/imrenagi/app", Image{Registry: "docker.io", Repository: "imrenagi/app"}},
+		// a first component without a dot or port is not a host
+		{"gcr/app", Image{Registry: "docker.io", Repository: "gcr/app"}},
+		// hosts with ports
+		{"localhost/app", Image{Registry: "localhost", Repository: "app"}},
+		{"localhost:5000/app:v1", Image{Registry: "localhost:5000", Repository: "app", Tag: "v1"}},
+		{"registry.local:5000/team/app", Image{Registry: "registry.local:5000", Repository: "team/app"}},
+		// digests
+		{"gcr.io/imre-demo/app@" + digest, Image{Registry: "gcr.io", Repository: "imre-demo/app", Digest: digest}},
+		{"gcr.io/imre-demo/app:v1@" + digest, Image{Registry: "gcr.io", Repository: "imre-demo/app", Tag: "v1", Digest: digest}},
+		// a look-alike host is a host of its own
+		{"gcr.io.evil.com/imre-demo/app", Image{Registry: "gcr.io.evil.com", Repository: "imre-demo/app"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := ParseImage(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseImageInvalid(t *testing.T) {
+	for _, image := range []string{
+		"",
+		"gcr.io/imre-demo/app@sha256:abc",
+		"gcr.io/imre-demo/app@evil.com/app",
+		"evil.com@gcr.io/imre-demo/app",
+		"gcr.io/imre-demo/../evil/app",
+		"gcr.io/../app",
+		"gcr.io//app",
+		"gcr.io/imre-demo/app:",
+		"gcr.io/imre-demo/app:v1:v2",
+		"gcr.io/Imre-Demo/app",
+		"-gcr.io/app",
+	} {
+		t.Run(image, func(t *testing.T) {
+			if img, err := ParseImage(image); err == nil {
+				t.Errorf("got %+v, want an error", img)
+			}
+		})
+	}
+}
+
+func TestRegistryPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		image   string
+		want    bool
+	}{
+		// a host allows every image of the host only
+		{"gcr.io", "gcr.io/imre-demo/app", true},
+		{"gcr.io", "gcr.io.evil.com/imre-demo/app", false},
+		{"gcr.io", "evil.com/gcr.io/app", false},
+		{"localhost:5000", "localhost:5000/app", true},
+		{"localhost:5000", "localhost:5001/app", false},
+		{"localhost:5000", "localhost/app", false},
+		// a repository allows itself and everything below it
+		{"gcr.io/foo", "gcr.io/foo", true},
+		{"gcr.io/foo", "gcr.io/foo/bar", true},
+		{"gcr.io/foo", "gcr.io/foobar", false},
+		{"gcr.io/foo/", "gcr.io/foobar", false},
+		// globs match the whole repository and never cross a slash
+		{"gcr.io/foo*", "gcr.io/foobar", true},
+		{"gcr.io/foo*", "gcr.io/foo", true},
+		{"gcr.io/foo*", "gcr.io/foobar/app", false},
+		{"gcr.io/foo*", "gcr.io.evil.com/foobar", false},
+		{"gcr.io/team-*/app", "gcr.io/team-a/app", true},
+		{"gcr.io/team-*/app", "gcr.io/team-a/app/sub", false},
+		{"gcr.io/team-?/app", "gcr.io/team-ab/app", false},
+		// `/*` allows everything below the repository but not itself
+		{"gcr.io/foo/*", "gcr.io/foo/bar", true},
+		{"gcr.io/foo/*", "gcr.io/foo/bar/baz", true},
+		{"gcr.io/foo/*", "gcr.io/foo", false},
+		{"gcr.io/foo/*", "gcr.io/foobar/app", false},
+		// official Docker Hub images
+		{"docker.io/library/nginx", "nginx", true},
+		{"docker.io/library/nginx", "nginx:1.19@" + digest, true},
+		{"docker.io/library/nginx", "evil/nginx", false},
+		{"docker.io/library", "nginx", true},
+		{"index.docker.io/library", "docker.io/nginx", true},
+		{"docker.io/imrenagi", "imrenagi/app", true},
+		{"docker.io/imrenagi", "imrenagi2/app", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.image, func(t *testing.T) {
+			p, err := ParseRegistryPattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := ParseImage(tt.image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Match(img); got != tt.want {
+				t.Errorf("Match(%s) = %v, want %v", img, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRegistryPatternInvalid(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"nginx",
+		"imre-demo/app",
+		"gcr.io/[",
+		"gcr.io:port/app",
+	} {
+		t.Run(pattern, func(t *testing.T) {
+			if p, err := ParseRegistryPattern(pattern); err == nil {
+				t.Errorf("got %+v, want an error", p)
+			}
+		})
+	}
+}
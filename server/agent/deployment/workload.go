@@ -0,0 +1,109 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Kinds of the workloads which run pods
+const (
+	KindDeployment  = "Deployment"
+	KindStatefulSet = "StatefulSet"
+	KindDaemonSet   = "DaemonSet"
+	KindReplicaSet  = "ReplicaSet"
+	KindJob         = "Job"
+	KindCronJob     = "CronJob"
+	KindPod         = "Pod"
+	// KindEphemeralContainers is the kind of the pods/ephemeralcontainers
+	// subresource before Kubernetes 1.23
+	KindEphemeralContainers = "EphemeralContainers"
+)
+
+// WorkloadKinds lists every kind ParseWorkload understands
+var WorkloadKinds = []string{
+	KindDeployment,
+	KindStatefulSet,
+	KindDaemonSet,
+	KindReplicaSet,
+	KindJob,
+	KindCronJob,
+	KindPod,
+	KindEphemeralContainers,
+}
+
+// Workload is an object which runs pods
+type Workload struct {
+	Kind       string
+	ObjectMeta metav1.ObjectMeta
+	// PodSpec is the spec of the pods run by the workload
+	PodSpec corev1.PodSpec
+	// PodSpecField is the path of the pod spec inside the object, ending with a dot
+	PodSpecField string
+}
+
+// ParseWorkload decodes an object of the given kind and extracts the template
+// of its pods
+func ParseWorkload(kind string, raw []byte) (*Workload, error) {
+	w := &Workload{Kind: kind}
+	switch kind {
+	case KindDeployment:
+		var obj appsv1.Deployment
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.Template.Spec, "spec.template.spec."
+	case KindStatefulSet:
+		var obj appsv1.StatefulSet
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.Template.Spec, "spec.template.spec."
+	case KindDaemonSet:
+		var obj appsv1.DaemonSet
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.Template.Spec, "spec.template.spec."
+	case KindReplicaSet:
+		var obj appsv1.ReplicaSet
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.Template.Spec, "spec.template.spec."
+	case KindJob:
+		var obj batchv1.Job
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.Template.Spec, "spec.template.spec."
+	case KindCronJob:
+		// batch/v1beta1 and batch/v1 CronJob share the same schema
+		var obj batchv1beta1.CronJob
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec.JobTemplate.Spec.Template.Spec, "spec.jobTemplate.spec.template.spec."
+	case KindPod:
+		var obj corev1.Pod
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpec, w.PodSpecField = obj.ObjectMeta, obj.Spec, "spec."
+	case KindEphemeralContainers:
+		var obj corev1.EphemeralContainers
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		w.ObjectMeta, w.PodSpecField = obj.ObjectMeta, ""
+		w.PodSpec = corev1.PodSpec{EphemeralContainers: obj.EphemeralContainers}
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %q", kind)
+	}
+	return w, nil
+}
@@ -0,0 +1,22 @@
+package agent
+
+// MergeStrings returns the union of a and b, keeping the order in which the
+// values first appear.
+func MergeStrings(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+
+	seen := make(map[string]bool, len(a)+len(b))
+	merged := make([]string, 0, len(a)+len(b))
+	for _, list := range [][]string{a, b} {
+		for _, s := range list {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// IDs of the rules enforced by the agents
+const (
+	RuleRegistry        = "registry"
+	RuleProbe           = "probe"
+	RuleConfigMapSecret = "configmap-secret"
+	RuleWorkloadSecret  = "workload-secret"
+)
+
+// Rules lists the ids of every rule
+var Rules = []string{
+	RuleRegistry,
+	RuleProbe,
+	RuleConfigMapSecret,
+	RuleWorkloadSecret,
+}
+
+// RuleDescriptions describes what each rule requires
+var RuleDescriptions = map[string]string{
+	RuleRegistry:        "Images must come from an allowed registry",
+	RuleProbe:           "Containers must have liveness and readiness probes",
+	RuleConfigMapSecret: "ConfigMaps must not contain secrets",
+	RuleWorkloadSecret:  "Containers must read secrets from Secrets instead of literal env values, command or args",
+}
+
+// Violation is a single problem found by a check
+type Violation struct {
+	RuleID string
+	// Container is the name of the offending container, if any
+	Container string
+	// Field is the path of the offending field, e.g. `containers[0].image`
+	Field   string
+	Message string
+	// Fingerprint identifies the secret of a secret finding without revealing
+	// it, see redact.Fingerprint
+	Fingerprint string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("[%s] %s", v.RuleID, v.Message)
+}
+
+// MarshalZerologObject logs a secret finding by its fingerprint only, as even
+// a censored secret must not end up in the logs. Other violations are logged
+// with their message.
+func (v Violation) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("rule", v.RuleID)
+	if v.Container != "" {
+		e.Str("container", v.Container)
+	}
+	e.Str("field", v.Field)
+	if v.Fingerprint != "" {
+		e.Str("fingerprint", v.Fingerprint)
+	} else {
+		e.Str("violation", v.Message)
+	}
+}
+
+// Violations is the list of problems found in an object
+type Violations []Violation
+
+// Error combines all the violations into a single message, one per line
+func (vs Violations) Error() string {
+	lines := make([]string, 0, len(vs))
+	for _, v := range vs {
+		lines = append(lines, v.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MarshalZerologArray logs every violation like MarshalZerologObject
+func (vs Violations) MarshalZerologArray(a *zerolog.Array) {
+	for _, v := range vs {
+		a.Object(v)
+	}
+}
+
+// WithFieldPrefix returns a copy of the violations where prefix is added in
+// front of each field, e.g. to place pod spec fields inside a deployment.
+func (vs Violations) WithFieldPrefix(prefix string) Violations {
+	prefixed := make(Violations, 0, len(vs))
+	for _, v := range vs {
+		if v.Field != "" {
+			v.Field = prefix + v.Field
+		}
+		prefixed = append(prefixed, v)
+	}
+	return prefixed
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/policy"
+)
+
+// agents are the validators built for one effective policy
+type agents struct {
+	policy     *policy.Policy
+	deployment *dep.Agent
+	configmap  *cm.Agent
+}
+
+// detectorKey identifies the detectors which can be shared between policies
+type detectorKey struct {
+	backend   string
+	projectID string
+}
+
+// agentCache builds the agents of a namespace once and reuses them until the
+// effective policy of the namespace changes. Detectors, and thus the DLP
+// connections, are shared by every policy using the same backend and project.
+type agentCache struct {
+	mu        sync.RWMutex
+	agents    map[string]*agents
+	detectors map[detectorKey]cm.Detector
+}
+
+// get returns the agents for the effective policy of the namespace
+func (c *agentCache) get(namespace string, p *policy.Policy) (*agents, error) {
+	c.mu.RLock()
+	a, ok := c.agents[namespace]
+	c.mu.RUnlock()
+	if ok && a.policy == p {
+		return a, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if a, ok := c.agents[namespace]; ok && a.policy == p {
+		return a, nil
+	}
+
+	deploymentAgent, err := dep.New(&p.Deployment)
+	if err != nil {
+		return nil, fmt.Errorf("failed when creating agent for deployment validator: %w", err)
+	}
+
+	detector, err := c.detector(&p.ConfigMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed when creating detector for configmap validator: %w", err)
+	}
+	configmapAgent, err := cm.New(&p.ConfigMap, detector)
+	if err != nil {
+		return nil, fmt.Errorf("failed when creating agent for configmap validator: %w", err)
+	}
+
+	a = &agents{
+		policy:     p,
+		deployment: deploymentAgent,
+		configmap:  configmapAgent,
+	}
+	if c.agents == nil {
+		c.agents = make(map[string]*agents)
+	}
+	c.agents[namespace] = a
+	return a, nil
+}
+
+// detector must be called with c.mu held
+func (c *agentCache) detector(cfg *cm.AgentConfig) (cm.Detector, error) {
+	key := detectorKey{backend: cfg.Detector}
+	if key.backend == "" || key.backend == cm.DetectorDLP {
+		key = detectorKey{backend: cm.DetectorDLP, projectID: cfg.GoogleProjectID}
+	}
+	if d, ok := c.detectors[key]; ok {
+		return d, nil
+	}
+
+	d, err := cm.NewDetector(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	if c.detectors == nil {
+		c.detectors = make(map[detectorKey]cm.Detector)
+	}
+	c.detectors[key] = d
+	return d, nil
+}
+
+// close releases every detector
+func (c *agentCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for key, d := range c.detectors {
+		if err := d.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.detectors, key)
+	}
+	c.agents = nil
+	return firstErr
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestMain(m *testing.M) {
+	// the agents log every inspection with the global logger
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// stubDetector finds nothing, so that the benchmarks measure the cost of the
+// agents rather than of an inspection
+type stubDetector struct{}
+
+func (stubDetector) Inspect(ctx context.Context, req cm.InspectRequest) ([]cm.Finding, error) {
+	return nil, nil
+}
+
+func (stubDetector) Close() error { return nil }
+
+var benchPolicy = &policy.Policy{
+	Deployment: dep.AgentConfig{
+		ImageRegistries: []string{"gcr.io/distroless", "europe-docker.pkg.dev/my-project"},
+	},
+	ConfigMap: cm.AgentConfig{
+		Detector: cm.DetectorOffline,
+		CustomInfoTypes: []cm.CustomInfoType{
+			{Name: "ACME_API_TOKEN", Regex: `acme_[a-z0-9]{32}`},
+		},
+	},
+}
+
+// newBenchCache returns an empty cache whose detector is the stub. With
+// Cloud DLP, building agents per request also dials a new gRPC connection,
+// which is left out here.
+func newBenchCache() agentCache {
+	return agentCache{
+		detectors: map[detectorKey]cm.Detector{
+			{backend: cm.DetectorOffline}: stubDetector{},
+		},
+	}
+}
+
+// newPerRequestAgents builds the agents like every request did before they
+// were cached
+func newPerRequestAgents(p *policy.Policy) (*agents, error) {
+	deploymentAgent, err := dep.New(&p.Deployment)
+	if err != nil {
+		return nil, err
+	}
+	configmapAgent, err := cm.New(&p.ConfigMap, stubDetector{})
+	if err != nil {
+		return nil, err
+	}
+	return &agents{policy: p, deployment: deploymentAgent, configmap: configmapAgent}, nil
+}
+
+func BenchmarkAgentCacheGet(b *testing.B) {
+	c := newBenchCache()
+	if _, err := c.get("default", benchPolicy); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.get("default", benchPolicy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAgentsPerRequest(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := newPerRequestAgents(benchPolicy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchConfigMapRequest(b *testing.B) *admissionv1.AdmissionRequest {
+	raw, err := json.Marshal(corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{agent.AnnotationShouldCheck: "true"},
+		},
+		Data: map[string]string{
+			"app.properties": "db.host=postgres\ndb.user=app\n",
+			"config.yaml":    "server:\n  port: 8080\n",
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:       "bench",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+func benchHandler() *Handler {
+	return &Handler{
+		Policies: policy.NewStore(benchPolicy),
+		Log:      zerolog.Nop(),
+		agents:   newBenchCache(),
+	}
+}
+
+func BenchmarkCheckConfigMapCached(b *testing.B) {
+	h := benchHandler()
+	req := benchConfigMapRequest(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if resp, _ := h.checkConfigMap(ctx, req); !resp.Allowed {
+			b.Fatal(resp.Result)
+		}
+	}
+}
+
+func BenchmarkCheckConfigMapPerRequest(b *testing.B) {
+	h := benchHandler()
+	req := benchConfigMapRequest(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// an empty cache builds the agents again, like every request did
+		// before they were cached
+		h.agents = newBenchCache()
+		if resp, _ := h.checkConfigMap(ctx, req); !resp.Allowed {
+			b.Fatal(resp.Result)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"golang.org/x/time/rate"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+)
+
+// auditPageSize is the number of objects listed per request
+const auditPageSize = 500
+
+// auditTarget is a kind of object checked by the auditor
+type auditTarget struct {
+	kind metav1.GroupVersionKind
+	list func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error)
+}
+
+var auditTargets = []auditTarget{
+	{
+		kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: dep.KindDeployment},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: dep.KindStatefulSet},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.AppsV1().StatefulSets(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: dep.KindDaemonSet},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.AppsV1().DaemonSets(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: dep.KindReplicaSet},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.AppsV1().ReplicaSets(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: dep.KindJob},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.BatchV1().Jobs(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: dep.KindCronJob},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.BatchV1beta1().CronJobs(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Version: "v1", Kind: dep.KindPod},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.CoreV1().Pods(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+	{
+		kind: metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		list: func(ctx context.Context, c kubernetes.Interface, opts metav1.ListOptions) (runtime.Object, error) {
+			return c.CoreV1().ConfigMaps(metav1.NamespaceAll).List(ctx, opts)
+		},
+	},
+}
+
+// AuditResult is the outcome of auditing one existing object
+type AuditResult struct {
+	Kind      metav1.GroupVersionKind
+	Namespace string
+	Name      string
+	UID       types.UID
+	// Allowed reports whether the webhook would admit the object now
+	Allowed bool
+	// Evaluation is nil when the object is skipped by the policy
+	Evaluation *Evaluation
+}
+
+// Auditor periodically checks the objects which already exist in the cluster,
+// such as the ones created before satpol-pp was installed or before the
+// policy changed. Violations are only recorded, nothing is modified or
+// deleted.
+type Auditor struct {
+	handler  *Handler
+	interval time.Duration
+	// dlp limits the inspections of configmaps and workloads, which may call
+	// Cloud DLP
+	dlp *rate.Limiter
+
+	mu      sync.RWMutex
+	results []AuditResult
+	scanned time.Time
+	// onScan is called with the results of every completed scan
+	onScan []func([]AuditResult)
+}
+
+// NewAuditor creates an auditor which scans the cluster every interval and
+// inspects at most inspectionsPerSecond objects per second. Zero or less
+// does not limit the inspections.
+func NewAuditor(h *Handler, interval time.Duration, inspectionsPerSecond float64) *Auditor {
+	limit := rate.Inf
+	if inspectionsPerSecond > 0 {
+		limit = rate.Limit(inspectionsPerSecond)
+	}
+	return &Auditor{
+		handler:  h,
+		interval: interval,
+		dlp:      rate.NewLimiter(limit, 1),
+	}
+}
+
+// OnScan registers fn to be called with the results of every completed scan
+func (a *Auditor) OnScan(fn func([]AuditResult)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onScan = append(a.onScan, fn)
+}
+
+// Results returns the results of the last completed scan and when it ended
+func (a *Auditor) Results() ([]AuditResult, time.Time) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.results, a.scanned
+}
+
+// Run scans the cluster right away and then every interval until ctx is done
+func (a *Auditor) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Scan(ctx); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Scan checks every existing object once. Kinds which can not be listed, e.g.
+// because the cluster does not serve their version, are skipped.
+func (a *Auditor) Scan(ctx context.Context) error {
+	start := time.Now()
+	var results []AuditResult
+	for _, target := range auditTargets {
+		r, err := a.scan(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			a.handler.Log.Error().Err(err).Str("kind", target.kind.Kind).Msg("failed when auditing objects")
+			continue
+		}
+		results = append(results, r...)
+	}
+
+	var violating int
+	for _, r := range results {
+		if r.Evaluation != nil && len(r.Evaluation.Decisions) > 0 {
+			violating++
+		}
+	}
+	a.handler.Log.Info().
+		Int("objects", len(results)).
+		Int("violating", violating).
+		Dur("duration", time.Since(start)).
+		Msg("audit scan completed")
+
+	a.mu.Lock()
+	a.results, a.scanned = results, time.Now()
+	onScan := a.onScan
+	a.mu.Unlock()
+
+	for _, fn := range onScan {
+		fn(results)
+	}
+	return nil
+}
+
+func (a *Auditor) scan(ctx context.Context, target auditTarget) ([]AuditResult, error) {
+	var results []AuditResult
+	opts := metav1.ListOptions{Limit: auditPageSize}
+	for {
+		list, err := target.list(ctx, a.handler.Clientset, opts)
+		if err != nil {
+			return nil, err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			r, err := a.check(ctx, target.kind, item)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				results = append(results, *r)
+			}
+		}
+
+		listMeta, err := meta.ListAccessor(list)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Continue = listMeta.GetContinue(); opts.Continue == "" {
+			return results, nil
+		}
+	}
+}
+
+// check reviews an existing object as if it was created again. It returns
+// nil when the object could not be checked.
+func (a *Auditor) check(ctx context.Context, kind metav1.GroupVersionKind, obj runtime.Object) (*AuditResult, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// workloads are always inspected for the secrets in their env and
+	// arguments, configmaps only when they should be checked
+	inspected := true
+	if configmap, ok := obj.(*corev1.ConfigMap); ok {
+		inspected, _ = cm.ShouldCheck(*configmap)
+	}
+	if inspected {
+		if err := a.dlp.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, eval := a.handler.Review(ctx, &admissionv1.AdmissionRequest{
+		UID:       uuid.NewUUID(),
+		Kind:      kind,
+		Name:      accessor.GetName(),
+		Namespace: accessor.GetNamespace(),
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	if eval == nil && !resp.Allowed {
+		msg := ""
+		if resp.Result != nil {
+			msg = resp.Result.Message
+		}
+		a.handler.Log.Warn().
+			Str("kind", kind.Kind).
+			Str("namespace", accessor.GetNamespace()).
+			Str("name", accessor.GetName()).
+			Str("error", msg).
+			Msg("unable to audit object")
+		return nil, nil
+	}
+
+	if eval != nil {
+		for _, d := range eval.Decisions {
+			a.handler.Log.Warn().
+				EmbedObject(d.Violation).
+				Str("action", string(d.Action)).
+				Str("kind", kind.Kind).
+				Str("namespace", accessor.GetNamespace()).
+				Str("name", accessor.GetName()).
+				Msg("existing object violates the policy")
+		}
+	}
+
+	return &AuditResult{
+		Kind:       kind,
+		Namespace:  accessor.GetNamespace(),
+		Name:       accessor.GetName(),
+		UID:        accessor.GetUID(),
+		Allowed:    resp.Allowed,
+		Evaluation: eval,
+	}, nil
+}
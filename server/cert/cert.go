@@ -0,0 +1,275 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+// Adapted from the helper/cert package of github.com/hashicorp/vault-k8s
+// v0.5.0, Copyright (c) HashiCorp, Inc. The license is in the LICENSE file of
+// this directory.
+
+// Package cert provides the TLS certificates of the webhook server, either
+// generated with a self-signed CA or read from disk, and notifies when they
+// change.
+package cert
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// retryInterval is how often a source is asked again for its certificates
+var retryInterval = 5 * time.Second
+
+// Bundle is the certificate and key to serve, and the CA certificate when it
+// is known
+type Bundle struct {
+	Cert   []byte
+	Key    []byte
+	CACert []byte
+}
+
+// Equal reports whether both bundles hold the same certificates
+func (b *Bundle) Equal(o *Bundle) bool {
+	return b != nil && o != nil &&
+		bytes.Equal(b.Cert, o.Cert) &&
+		bytes.Equal(b.Key, o.Key) &&
+		bytes.Equal(b.CACert, o.CACert)
+}
+
+// Source loads the certificates. last is the bundle returned previously, or
+// nil on the first call, and a source may block until it changes.
+type Source interface {
+	Certificate(ctx context.Context, last *Bundle) (Bundle, error)
+}
+
+// DiskSource reads PEM encoded certificates from disk
+type DiskSource struct {
+	CertPath string
+	KeyPath  string
+	// CAPath is optional
+	CAPath string
+}
+
+// Certificate returns the content of the files. Changes are picked up by the
+// next call of the Notify loop.
+func (s *DiskSource) Certificate(ctx context.Context, last *Bundle) (Bundle, error) {
+	var (
+		bundle Bundle
+		err    error
+	)
+	if bundle.Cert, err = ioutil.ReadFile(s.CertPath); err != nil {
+		return Bundle{}, err
+	}
+	if bundle.Key, err = ioutil.ReadFile(s.KeyPath); err != nil {
+		return Bundle{}, err
+	}
+	if s.CAPath != "" {
+		if bundle.CACert, err = ioutil.ReadFile(s.CAPath); err != nil {
+			return Bundle{}, err
+		}
+	}
+	return bundle, nil
+}
+
+// GenSource generates a self-signed CA once, and a certificate signed by it
+// for the hosts, which is renewed before it expires
+type GenSource struct {
+	// Name is part of the common name of both certificates
+	Name  string
+	Hosts []string
+	// Expiry is how long a certificate is valid, 24 hours when empty
+	Expiry time.Duration
+
+	mu       sync.Mutex
+	caCert   []byte
+	ca       *x509.Certificate
+	caSigner *ecdsa.PrivateKey
+}
+
+// Certificate generates the certificate, waiting until the last one is about
+// to expire when there is one
+func (s *GenSource) Certificate(ctx context.Context, last *Bundle) (Bundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ca == nil {
+		if err := s.generateCA(); err != nil {
+			return Bundle{}, err
+		}
+	}
+
+	if last != nil {
+		crt, err := parseCert(last.Cert)
+		if err != nil {
+			return Bundle{}, err
+		}
+		// renew when a tenth of the validity is left
+		timer := time.NewTimer(time.Until(crt.NotAfter) - s.expiry()/10)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return Bundle{}, ctx.Err()
+		}
+	}
+
+	crt, key, err := s.generateCert()
+	if err != nil {
+		return Bundle{}, err
+	}
+	return Bundle{Cert: crt, Key: key, CACert: s.caCert}, nil
+}
+
+func (s *GenSource) expiry() time.Duration {
+	if s.Expiry > 0 {
+		return s.Expiry
+	}
+	return 24 * time.Hour
+}
+
+func (s *GenSource) generateCA() error {
+	signer, _, err := privateKey()
+	if err != nil {
+		return err
+	}
+	sn, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: s.Name + " CA"},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	s.ca, s.caSigner = ca, signer
+	s.caCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+func (s *GenSource) generateCert() ([]byte, []byte, error) {
+	signer, key, err := privateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	sn, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{CommonName: s.Name + " Service"},
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(s.expiry()),
+	}
+	for _, h := range s.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, signer.Public(), s.caSigner)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key, nil
+}
+
+// privateKey returns a new ECDSA key, and the key PEM encoded
+func privateKey() (*ecdsa.PrivateKey, []byte, error) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 159))
+}
+
+func parseCert(value []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Notify sends the bundle of a source on a channel each time it changes
+type Notify struct {
+	ctx    context.Context
+	ch     chan<- Bundle
+	source Source
+}
+
+// NewNotify creates a Notify sending the bundles of source on ch
+func NewNotify(ctx context.Context, ch chan<- Bundle, source Source) *Notify {
+	return &Notify{
+		ctx:    ctx,
+		ch:     ch,
+		source: source,
+	}
+}
+
+// Run blocks until ctx is done
+func (n *Notify) Run() {
+	var last *Bundle
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		next, err := n.source.Certificate(n.ctx, last)
+		if err != nil {
+			log.Error().Err(err).Msg("unable to load certificates")
+		} else if !last.Equal(&next) {
+			last = &next
+			select {
+			case n.ch <- next:
+			case <-n.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
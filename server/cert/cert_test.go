@@ -0,0 +1,167 @@
+package cert
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+	// failing sources are logged with the global logger
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+func TestGenSourceCertificate(t *testing.T) {
+	s := &GenSource{Name: "satpolpp", Hosts: []string{"satpolpp.default.svc", "127.0.0.1"}}
+	bundle, err := s.Certificate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := parseCert(bundle.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := parseCert(bundle.CACert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for _, host := range s.Hosts {
+		if _, err := crt.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("certificate is not valid for %s: %v", host, err)
+		}
+	}
+	if validity := crt.NotAfter.Sub(time.Now()); validity < 23*time.Hour || validity > 24*time.Hour {
+		t.Errorf("certificate is valid for %s, want 24h by default", validity)
+	}
+}
+
+func TestGenSourceRenewal(t *testing.T) {
+	const expiry = 500 * time.Millisecond
+	s := &GenSource{Name: "satpolpp", Hosts: []string{"satpolpp"}, Expiry: expiry}
+	first, err := s.Certificate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := parseCert(first.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	second, err := s.Certificate(context.Background(), &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := time.Now()
+
+	// the certificate is renewed when a tenth of its validity is left
+	if want := crt.NotAfter.Add(-expiry / 10); renewed.Before(want) {
+		t.Errorf("renewed %s before %s", want.Sub(renewed), want)
+	}
+	if waited := renewed.Sub(start); waited > expiry {
+		t.Errorf("waited %s to renew, want less than the validity of %s", waited, expiry)
+	}
+	if first.Equal(&second) {
+		t.Error("renewed bundle is the same as the first one")
+	}
+	if string(first.CACert) != string(second.CACert) {
+		t.Error("CA changed on renewal")
+	}
+}
+
+func TestGenSourceRenewalCanceled(t *testing.T) {
+	s := &GenSource{Name: "satpolpp", Expiry: time.Hour}
+	first, err := s.Certificate(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Certificate(ctx, &first); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// sequenceSource returns its results in order, then blocks until ctx is done
+type sequenceSource struct {
+	mu      sync.Mutex
+	results []sourceResult
+}
+
+type sourceResult struct {
+	bundle Bundle
+	err    error
+}
+
+func (s *sequenceSource) Certificate(ctx context.Context, last *Bundle) (Bundle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.results) == 0 {
+		<-ctx.Done()
+		return Bundle{}, ctx.Err()
+	}
+	r := s.results[0]
+	s.results = s.results[1:]
+	return r.bundle, r.err
+}
+
+func TestNotifyRun(t *testing.T) {
+	defer func(interval time.Duration) { retryInterval = interval }(retryInterval)
+	retryInterval = time.Millisecond
+
+	a := Bundle{Cert: []byte("a"), Key: []byte("a")}
+	b := Bundle{Cert: []byte("b"), Key: []byte("b")}
+	c := Bundle{Cert: []byte("b"), Key: []byte("b"), CACert: []byte("c")}
+	source := &sequenceSource{results: []sourceResult{
+		{bundle: a},
+		{bundle: a},
+		{bundle: b},
+		{err: errors.New("unavailable")},
+		{bundle: b},
+		{bundle: c},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan Bundle)
+	done := make(chan struct{})
+	go func() {
+		NewNotify(ctx, ch, source).Run()
+		close(done)
+	}()
+
+	// unchanged bundles and errors are not sent
+	for i, want := range []Bundle{a, b, c} {
+		select {
+		case got := <-ch:
+			if !got.Equal(&want) {
+				t.Errorf("bundle %d is %q, want %q", i, got.Cert, want.Cert)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("bundle %d was not sent", i)
+		}
+	}
+	select {
+	case got := <-ch:
+		t.Errorf("unexpected bundle %q", got.Cert)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return when the context was done")
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// eventComponent is the source of the events
+	eventComponent = "satpol-pp"
+	// eventDedupWindow is how long an identical event is not recorded again
+	eventDedupWindow = 10 * time.Minute
+	// maxEventMessage is the longest message accepted by the API server
+	maxEventMessage = 1024
+)
+
+// Reasons of the events
+const (
+	ReasonPolicyViolationDenied = "PolicyViolationDenied"
+	ReasonPolicyViolationWarned = "PolicyViolationWarned"
+)
+
+// EventRecorder records a Kubernetes Event when an admission request is denied
+// or warned, so that the violations are visible with `kubectl describe` even
+// when the object is applied by a GitOps controller. Updates are recorded on
+// the object, while creates are recorded on the namespace since the object
+// does not exist yet.
+type EventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	log         zerolog.Logger
+
+	mu     sync.Mutex
+	recent map[string]time.Time
+}
+
+// NewEventRecorder creates a recorder which writes the events with clientset
+func NewEventRecorder(clientset kubernetes.Interface, log zerolog.Logger) *EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events(metav1.NamespaceAll)})
+	return &EventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		log:         log,
+		recent:      make(map[string]time.Time),
+	}
+}
+
+// Shutdown stops writing events
+func (e *EventRecorder) Shutdown() {
+	e.broadcaster.Shutdown()
+}
+
+// Record records an event for the violations of an admission request which
+// were denied or warned. It can be registered with Handler.OnReview.
+func (e *EventRecorder) Record(req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *Evaluation) {
+	if eval == nil || len(eval.Decisions) == 0 {
+		return
+	}
+
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return
+	}
+	name := obj.Name
+	if name == "" {
+		name = obj.GenerateName
+	}
+
+	reason := ReasonPolicyViolationWarned
+	if !resp.Allowed {
+		reason = ReasonPolicyViolationDenied
+	}
+
+	var violations []string
+	for _, d := range eval.Decisions {
+		if d.Action == policy.ActionEnforce || d.Action == policy.ActionWarn {
+			violations = append(violations, d.String())
+		}
+	}
+	if len(violations) == 0 {
+		return
+	}
+
+	verb := "warned"
+	if !resp.Allowed {
+		verb = "denied"
+	}
+	message := fmt.Sprintf("%s of %s %s %s: %s", strings.ToLower(string(req.Operation)), req.Kind.Kind, name, verb, strings.Join(violations, "; "))
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       req.Namespace,
+		Namespace:  req.Namespace,
+	}
+	if req.Operation != admissionv1.Create && obj.UID != "" {
+		ref = &corev1.ObjectReference{
+			APIVersion: schema.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version}.String(),
+			Kind:       req.Kind.Kind,
+			Name:       obj.Name,
+			Namespace:  req.Namespace,
+			UID:        obj.UID,
+		}
+	}
+
+	if e.seen(fmt.Sprintf("%s/%s/%s/%s/%s", ref.Kind, ref.Namespace, ref.Name, reason, message)) {
+		return
+	}
+	e.log.Debug().Str("reason", reason).Str("kind", ref.Kind).Str("name", ref.Name).Msg("recording event")
+	e.recorder.Event(ref, corev1.EventTypeWarning, reason, message)
+}
+
+// seen reports whether the same event was recorded within the dedup window,
+// and remembers it otherwise. The event correlator of client-go also
+// aggregates events, but still patches the count of every repeated one.
+func (e *EventRecorder) seen(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := e.recent[key]; ok && now.Sub(last) < eventDedupWindow {
+		return true
+	}
+	for k, last := range e.recent {
+		if now.Sub(last) >= eventDedupWindow {
+			delete(e.recent, k)
+		}
+	}
+	e.recent[key] = now
+	return false
+}
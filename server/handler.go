@@ -1,21 +1,29 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/imrenagi/satpol-pp/server/agent"
 	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
 	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/metrics"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/imrenagi/satpol-pp/server/redact"
 	"github.com/rs/zerolog"
-	"k8s.io/api/admission/v1beta1"
-	appsv1 "k8s.io/api/apps/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes"
 )
@@ -26,6 +34,18 @@ var (
 		return codecs.UniversalDeserializer()
 	}
 
+	supportedReviewVersions = map[schema.GroupVersionKind]bool{
+		admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"):      true,
+		admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview"): true,
+	}
+
+	// responseMargin is kept from the admission timeout to send the response
+	responseMargin = time.Second
+
+	// MaxAdmissionTimeout is the longest timeoutSeconds of a webhook, so the
+	// server must be able to write a response for at least that long
+	MaxAdmissionTimeout = 30 * time.Second
+
 	kubeSystemNamespaces = []string{
 		metav1.NamespaceSystem,
 		metav1.NamespacePublic,
@@ -34,101 +54,182 @@ var (
 
 // Handler is the HTTP handler for admission webhooks.
 type Handler struct {
-	Clientset *kubernetes.Clientset
+	Clientset kubernetes.Interface
+	Policies  *policy.Store
 	Log       zerolog.Logger
+
+	agents agentCache
+	// owners are the controllers found by createdByController, by the time
+	// they were found
+	owners sync.Map
+	// onReview is called after each admission request was checked
+	onReview []ReviewFunc
+}
+
+// NewHandler creates a Handler and builds the agents of the cluster wide
+// policy, so that a broken detector configuration fails at start up rather
+// than on the first request.
+func NewHandler(clientset kubernetes.Interface, policies *policy.Store, log zerolog.Logger) (*Handler, error) {
+	h := &Handler{
+		Clientset: clientset,
+		Policies:  policies,
+		Log:       log,
+	}
+	if _, err := h.agents.get(metav1.NamespaceAll, policies.For(metav1.NamespaceAll)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Close releases the resources shared by the agents, such as the DLP client
+func (h *Handler) Close() error {
+	return h.agents.close()
 }
 
 // DeploymentCheckHandler ...
 func (h *Handler) DeploymentCheckHandler() http.HandlerFunc {
+	return h.WorkloadCheckHandler(dep.KindDeployment)
+}
+
+// WorkloadCheckHandler checks the pods run by workloads of the given kind. The
+// Pod handler also checks the pods/ephemeralcontainers subresource.
+func (h *Handler) WorkloadCheckHandler(kind string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.handle(w, r, h.checkDeployment)
+		h.handle(w, r, func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			resp, eval := h.checkWorkload(ctx, kind, req)
+			observe(r.URL.Path, req, resp, eval)
+			h.reviewed(req, resp, eval)
+			return resp
+		})
 	}
 }
 
-func (h *Handler) checkDeployment(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
-	var deployment appsv1.Deployment
-	if err := json.Unmarshal(req.Object.Raw, &deployment); err != nil {
-		h.Log.Error().Err(err).Msg("could not unmarshal request to deployment")
-		h.Log.Debug().Str("raw", string(req.Object.Raw)).Msg("deployment manifest")
-		return &v1beta1.AdmissionResponse{
+// checkWorkload returns the response to the request and, unless the workload
+// was skipped, how it was evaluated
+func (h *Handler) checkWorkload(ctx context.Context, kind string, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, *Evaluation) {
+	if req.Kind.Kind != kind && !(kind == dep.KindPod && req.Kind.Kind == dep.KindEphemeralContainers) {
+		return admissionError(fmt.Errorf("%s check received a %s", kind, req.Kind.Kind)), nil
+	}
+
+	workload, err := dep.ParseWorkload(req.Kind.Kind, req.Object.Raw)
+	if err != nil {
+		h.Log.Error().Err(err).Str("kind", req.Kind.Kind).Msg("could not unmarshal request to workload")
+		h.Log.Debug().Str("raw", redact.Bytes(req.Object.Raw)).Msg("workload manifest")
+		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, nil
 	}
 
 	// Build the basic response
-	reviewResponse := &v1beta1.AdmissionResponse{
+	reviewResponse := &admissionv1.AdmissionResponse{
 		Allowed: true,
 		UID:     req.UID,
 	}
 
-	h.Log.Debug().Msg("checking if should ignore this deployment")
-	ignore, err := dep.ShouldIgnore(deployment)
+	h.Log.Debug().Str("kind", workload.Kind).Msg("checking if should ignore this workload")
+	ignore, err := dep.ShouldIgnore(&workload.ObjectMeta)
 	if err != nil && !strings.Contains(err.Error(), "no inject annotation found") {
 		err := fmt.Errorf("error checking if should ignore this pod: %s", err)
-		return admissionError(err)
+		return admissionError(err), nil
 	} else if ignore {
-		return reviewResponse
+		return reviewResponse, nil
+	}
+
+	// workloads created by a controller, such as the replicasets of a
+	// deployment or the pods of a replicaset, were already checked through the
+	// template of their owner. Updates are always checked, as they may change
+	// the images of the object itself.
+	if req.Operation == admissionv1.Create && req.SubResource == "" {
+		if ref := metav1.GetControllerOf(&workload.ObjectMeta); ref != nil && h.createdByController(ctx, req.Namespace, req.UserInfo.Username, ref) {
+			return reviewResponse, nil
+		}
 	}
 
 	h.Log.Debug().Msg("checking namespaces..")
 	if strutil.StrListContains(kubeSystemNamespaces, req.Namespace) {
-		return reviewResponse
+		return reviewResponse, nil
 	}
 
-	var agentCfg dep.AgentConfig
-	err = dep.Init(&agentCfg)
-	if err != nil {
-		err := fmt.Errorf("failed when init deployment agent config")
-		return admissionError(err)
+	if workload.ObjectMeta.Namespace == "" {
+		workload.ObjectMeta.Namespace = req.Namespace
+	}
+	if _, err := cm.AnnotatedAllowedFindings(workload.ObjectMeta); err != nil {
+		return admissionError(fmt.Errorf("invalid annotation %s", err)), nil
+	}
+	pol := h.Policies.For(req.Namespace)
+	if pol.Exempt(kind, req.Namespace, workload.ObjectMeta.Name) {
+		h.Log.Debug().Str("kind", kind).Str("name", workload.ObjectMeta.Name).Msg("workload is exempted by policy")
+		return reviewResponse, nil
 	}
 
-	agent, err := dep.New(&agentCfg)
+	agents, err := h.agents.get(req.Namespace, pol)
 	if err != nil {
-		err := fmt.Errorf("failed when creating agent for deployment validator")
-		return admissionError(err)
+		return admissionError(err), nil
 	}
 
-	if err := agent.ValidRegistry(deployment.Spec.Template.Spec); err != nil {
-		h.Log.Warn().Err(err).Msg("pod contains unidentified registry")
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{Message: err.Error()}
+	eval := &Evaluation{Rules: []string{agent.RuleRegistry}}
+	start := time.Now()
+	violations := agents.deployment.ValidRegistry(workload.PodSpec)
+	metrics.CheckDuration.WithLabelValues(agent.RuleRegistry).Observe(time.Since(start).Seconds())
+	if agents.deployment.ProbesRequired(workload.Kind) {
+		eval.Rules = append(eval.Rules, agent.RuleProbe)
+		start := time.Now()
+		violations = append(violations, agents.deployment.ValidProbe(workload.PodSpec)...)
+		metrics.CheckDuration.WithLabelValues(agent.RuleProbe).Observe(time.Since(start).Seconds())
 	}
+	violations = violations.WithFieldPrefix(workload.PodSpecField)
 
-	if err := agent.ValidProbe(deployment.Spec.Template.Spec); err != nil {
-		h.Log.Warn().Err(err).Msg("pod has no valid probe")
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{Message: err.Error()}
+	start = time.Now()
+	secrets, err := agents.configmap.ValidateWorkload(ctx, workload.ObjectMeta, workload.PodSpec, workload.PodSpecField)
+	metrics.CheckDuration.WithLabelValues(agent.RuleWorkloadSecret).Observe(time.Since(start).Seconds())
+	if err != nil {
+		// the other rules are still enforced when the request fails open
+		if resp := h.checkFailed(reviewResponse, req, workload.ObjectMeta.Name, pol, agent.RuleWorkloadSecret, err); !resp.Allowed {
+			return resp, nil
+		}
+	} else {
+		eval.Rules = append(eval.Rules, agent.RuleWorkloadSecret)
+		violations = append(violations, secrets...)
+	}
+	if len(violations) > 0 {
+		h.Log.Warn().Array("violations", violations).Str("kind", workload.Kind).Msg("workload violates the policy")
+		eval.Decisions = h.enforce(reviewResponse, req, workload.ObjectMeta.Name, pol, violations)
 	}
 
-	return reviewResponse
+	return reviewResponse, eval
 }
 
 // ConfigMapCheckHandler ...
 func (h *Handler) ConfigMapCheckHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		h.handle(w, r, h.checkConfigMap)
+		h.handle(w, r, func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			resp, eval := h.checkConfigMap(ctx, req)
+			observe(r.URL.Path, req, resp, eval)
+			h.reviewed(req, resp, eval)
+			return resp
+		})
 	}
 }
 
-func (h *Handler) checkConfigMap(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse {
+func (h *Handler) checkConfigMap(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, *Evaluation) {
 
 	h.Log.Debug().Msg("executing configmap handler")
 
 	var configmap corev1.ConfigMap
 	if err := json.Unmarshal(req.Object.Raw, &configmap); err != nil {
 		h.Log.Error().Err(err).Msg("could not unmarshal request to configmap")
-		h.Log.Debug().Str("raw", string(req.Object.Raw)).Msg("configmap manifest")
-		return &v1beta1.AdmissionResponse{
+		h.Log.Debug().Str("raw", redact.Bytes(req.Object.Raw)).Msg("configmap manifest")
+		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, nil
 	}
 
 	// Build the basic response
-	reviewResponse := &v1beta1.AdmissionResponse{
+	reviewResponse := &admissionv1.AdmissionResponse{
 		Allowed: true,
 		UID:     req.UID,
 	}
@@ -137,39 +238,56 @@ func (h *Handler) checkConfigMap(req *v1beta1.AdmissionRequest) *v1beta1.Admissi
 	check, err := cm.ShouldCheck(configmap)
 	if err != nil && !strings.Contains(err.Error(), "no inject annotation found") {
 		err := fmt.Errorf("error checking if should ignore this configmap: %s", err)
-		return admissionError(err)
+		return admissionError(err), nil
 	} else if !check {
-		return reviewResponse
+		return reviewResponse, nil
 	}
 
 	h.Log.Debug().Msg("checking namespaces..")
 	if strutil.StrListContains(kubeSystemNamespaces, req.Namespace) {
-		return reviewResponse
+		return reviewResponse, nil
 	}
 
-	agentCfg := &cm.AgentConfig{
-		GoogleProjectID: "imre-demo",
+	if configmap.Namespace == "" {
+		configmap.Namespace = req.Namespace
+	}
+	if _, err := cm.AnnotatedAllowedFindings(configmap.ObjectMeta); err != nil {
+		return admissionError(fmt.Errorf("invalid annotation %s", err)), nil
 	}
 
-	agent, err := cm.New(agentCfg)
+	pol := h.Policies.For(req.Namespace)
+	if pol.Exempt(req.Kind.Kind, req.Namespace, configmap.Name) {
+		h.Log.Debug().Str("name", configmap.Name).Msg("configmap is exempted by policy")
+		return reviewResponse, nil
+	}
+
+	agents, err := h.agents.get(req.Namespace, pol)
 	if err != nil {
-		return admissionError(err)
+		return admissionError(err), nil
 	}
 
-	err = agent.Validate(configmap)
+	start := time.Now()
+	violations, err := agents.configmap.Validate(ctx, configmap)
+	metrics.CheckDuration.WithLabelValues(agent.RuleConfigMapSecret).Observe(time.Since(start).Seconds())
 	if err != nil {
+		return h.checkFailed(reviewResponse, req, configmap.Name, pol, agent.RuleConfigMapSecret, err), nil
+	}
+	eval := &Evaluation{Rules: []string{agent.RuleConfigMapSecret}}
+	if len(violations) > 0 {
 		h.Log.Debug().Msg("configmap is not valid")
-		reviewResponse.Allowed = false
-		reviewResponse.Result = &metav1.Status{Message: err.Error()}
+		eval.Decisions = h.enforce(reviewResponse, req, configmap.Name, pol, violations)
 	}
 
-	return reviewResponse
+	return reviewResponse, eval
 }
 
-type admissionFunc func(req *v1beta1.AdmissionRequest) *v1beta1.AdmissionResponse
+type admissionFunc func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
 
 func (h *Handler) handle(w http.ResponseWriter, r *http.Request, fn admissionFunc) {
 	h.Log.Info().Str("method", r.Method).Str("method", r.Method).Msg("Request received")
+	defer func(start time.Time) {
+		metrics.HandleDuration.WithLabelValues(r.URL.Path).Observe(time.Since(start).Seconds())
+	}(time.Now())
 
 	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
 		msg := fmt.Sprintf("Invalid content-type: %q", ct)
@@ -195,16 +313,35 @@ func (h *Handler) handle(w http.ResponseWriter, r *http.Request, fn admissionFun
 		return
 	}
 
-	var admReq v1beta1.AdmissionReview
-	var admResp v1beta1.AdmissionReview
-	if _, _, err := deserializer().Decode(body, nil, &admReq); err != nil {
+	// admission.k8s.io/v1beta1 and v1 AdmissionReview share the same schema,
+	// so both are decoded into the v1 type and the response is sent back in
+	// the version of the request.
+	var admReq admissionv1.AdmissionReview
+	_, gvk, err := deserializer().Decode(body, nil, &admReq)
+	if err != nil {
 		msg := fmt.Sprintf("error decoding admission request: %s", err)
 		http.Error(w, msg, http.StatusInternalServerError)
 		h.Log.Error().Str("msg", msg).Int("code", http.StatusInternalServerError).Msg("error on request")
 		return
 	}
+	if !supportedReviewVersions[*gvk] || admReq.Request == nil {
+		msg := fmt.Sprintf("unsupported admission review %s", gvk)
+		http.Error(w, msg, http.StatusBadRequest)
+		h.Log.Error().Str("msg", msg).Int("code", http.StatusBadRequest).Msg("error on request")
+		return
+	}
+
+	ctx, cancel := admissionContext(r)
+	defer cancel()
 
-	admResp.Response = fn(admReq.Request)
+	admResp := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: gvk.GroupVersion().String(),
+			Kind:       gvk.Kind,
+		},
+		Response: fn(ctx, admReq.Request),
+	}
+	admResp.Response.UID = admReq.Request.UID
 
 	resp, err := json.Marshal(&admResp)
 	if err != nil {
@@ -219,8 +356,27 @@ func (h *Handler) handle(w http.ResponseWriter, r *http.Request, fn admissionFun
 	}
 }
 
-func admissionError(err error) *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+// admissionContext returns the context of an admission request. The API server
+// gives up on the webhook after the `timeout` query parameter, so the checks
+// are given up a little earlier to still answer with their onError action.
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	if timeout > MaxAdmissionTimeout {
+		timeout = MaxAdmissionTimeout
+	}
+	if timeout > 2*responseMargin {
+		timeout -= responseMargin
+	} else {
+		timeout /= 2
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+func admissionError(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
 		},
@@ -0,0 +1,213 @@
+// Package manifest reads Kubernetes objects from YAML and JSON manifests
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+)
+
+// Stdin is the path which reads the manifests from the standard input
+const Stdin = "-"
+
+// extensions are the files read when walking a directory
+var extensions = map[string]bool{
+	".yaml": true,
+	".yml":  true,
+	".json": true,
+}
+
+// Object is an object found in a manifest
+type Object struct {
+	// Source is the file the object was read from
+	Source string
+	// Index is the position of the YAML document or JSON object in the file
+	Index int
+	// Raw is the object encoded as JSON, as it is sent to the webhook
+	Raw []byte
+	*unstructured.Unstructured
+
+	node *yaml.Node
+}
+
+// ReadPaths reads every object from the given files and directories.
+// Directories are walked for .yaml, .yml and .json files, and `-` reads stdin.
+func ReadPaths(paths []string, stdin io.Reader) ([]Object, error) {
+	var objects []Object
+	for _, p := range paths {
+		if p == Stdin {
+			objs, err := Read("<stdin>", stdin)
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, objs...)
+			continue
+		}
+
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || (path != p && !extensions[strings.ToLower(filepath.Ext(path))]) {
+				return nil
+			}
+			objs, err := ReadFile(path)
+			if err != nil {
+				return err
+			}
+			objects = append(objects, objs...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// ReadFile reads every object of a manifest file
+func ReadFile(path string) ([]Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(path, f)
+}
+
+// Read reads every object of a manifest. The manifest may contain several YAML
+// documents, and lists such as `kind: List` are flattened into their items.
+// JSON is read as YAML, so a file may also contain a JSON object.
+func Read(source string, r io.Reader) ([]Object, error) {
+	var objects []Object
+	decoder := yaml.NewDecoder(r)
+	for i := 0; ; i++ {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", source, i, err)
+		}
+		if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+			continue
+		}
+
+		obj, err := newObject(source, i, doc.Content[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %w", source, i, err)
+		}
+		if !obj.IsList() {
+			objects = append(objects, obj)
+			continue
+		}
+
+		items, _ := lookup(obj.node, "items")
+		if items == nil || items.Kind != yaml.SequenceNode {
+			continue
+		}
+		for j, node := range items.Content {
+			item, err := newObject(source, i, node)
+			if err != nil {
+				return nil, fmt.Errorf("%s: document %d: items[%d]: %w", source, i, j, err)
+			}
+			objects = append(objects, item)
+		}
+	}
+	return objects, nil
+}
+
+// Line returns the line of the field in the manifest, e.g. of
+// `spec.template.spec.containers[0].image`. When the field is not in the
+// manifest the line of its closest parent is returned.
+func (o Object) Line(field string) int {
+	node := o.node
+	line := node.Line
+	for _, key := range splitField(field) {
+		var keyLine int
+		if node, keyLine = lookup(node, key); node == nil {
+			break
+		}
+		line = keyLine
+	}
+	return line
+}
+
+func newObject(source string, index int, node *yaml.Node) (Object, error) {
+	if node.Kind != yaml.MappingNode {
+		return Object{}, fmt.Errorf("object must be a mapping")
+	}
+
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return Object{}, err
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return Object{}, err
+	}
+	// decode again to get the types used by unstructured objects, such as
+	// int64 for numbers
+	var content map[string]interface{}
+	if err := utiljson.Unmarshal(raw, &content); err != nil {
+		return Object{}, err
+	}
+
+	u := &unstructured.Unstructured{Object: content}
+	if u.GetKind() == "" || u.GetAPIVersion() == "" {
+		return Object{}, fmt.Errorf("object has no apiVersion or kind")
+	}
+	return Object{Source: source, Index: index, Raw: raw, Unstructured: u, node: node}, nil
+}
+
+// splitField splits a field path such as `spec.containers[0].image` or
+// `data[app.properties]` into its keys and indexes
+func splitField(field string) []string {
+	var keys []string
+	for field != "" {
+		switch i := strings.IndexAny(field, ".["); {
+		case i < 0:
+			keys, field = append(keys, field), ""
+		case field[i] == '.':
+			keys, field = append(keys, field[:i]), field[i+1:]
+		default:
+			if i > 0 {
+				keys = append(keys, field[:i])
+			}
+			end := strings.Index(field[i:], "]")
+			if end < 0 {
+				return append(keys, field[i:])
+			}
+			keys = append(keys, field[i+1:i+end])
+			field = strings.TrimPrefix(field[i+end+1:], ".")
+		}
+	}
+	return keys
+}
+
+// lookup returns the value of a key in a mapping or of an index in a
+// sequence, and the line where the key or the item starts
+func lookup(node *yaml.Node, key string) (*yaml.Node, int) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1], node.Content[i].Line
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i], node.Content[i].Line
+		}
+	case yaml.AliasNode:
+		return lookup(node.Alias, key)
+	}
+	return nil, 0
+}
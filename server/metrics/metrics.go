@@ -0,0 +1,79 @@
+// Package metrics holds the Prometheus metrics of the webhook
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "satpolpp"
+
+// Decisions of an admission request
+const (
+	DecisionAllowed = "allowed"
+	DecisionWarned  = "warned"
+	DecisionDenied  = "denied"
+	// DecisionError is an object which could not be checked
+	DecisionError = "error"
+)
+
+var (
+	// AdmissionRequests counts the admission requests by their decision
+	AdmissionRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission requests by webhook path, kind, namespace and decision.",
+	}, []string{"path", "kind", "namespace", "decision"})
+
+	// Violations counts the policy violations by rule and enforcement action
+	Violations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "violations_total",
+		Help:      "Policy violations found in admission requests by webhook path, kind, namespace, rule and action.",
+	}, []string{"path", "kind", "namespace", "rule", "action"})
+
+	// HandleDuration observes how long an admission request takes to handle
+	HandleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handle_duration_seconds",
+		Help:      "Time taken to handle an admission request by webhook path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path"})
+
+	// CheckDuration observes how long each check of an object takes
+	CheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "check_duration_seconds",
+		Help:      "Time taken by each check of an object by rule.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"rule"})
+
+	// DLPInspectDuration observes the Cloud DLP InspectContent calls
+	DLPInspectDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dlp_inspect_duration_seconds",
+		Help:      "Time taken by Cloud DLP InspectContent calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// DLPInspectErrors counts the failed Cloud DLP InspectContent calls
+	DLPInspectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dlp_inspect_errors_total",
+		Help:      "Failed Cloud DLP InspectContent calls by gRPC status code.",
+	}, []string{"code"})
+
+	// DetectorCircuitOpen is 1 while the circuit breaker of a detector is open
+	DetectorCircuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "detector_circuit_open",
+		Help:      "Whether the circuit breaker of the detector is open and the detector is not called.",
+	}, []string{"detector"})
+
+	// CheckErrors counts the checks which failed by the action taken instead
+	CheckErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "check_errors_total",
+		Help:      "Checks which could not be completed by rule and the onError action taken, allow and warn fail open.",
+	}, []string{"rule", "action"})
+)
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// movedSecretGracePeriod is how long a Secret without an owner is kept while
+// its configmap does not exist, as the request creating the configmap may
+// still be admitted
+const movedSecretGracePeriod = 5 * time.Minute
+
+// MovedSecretReconciler completes what can not be done while a configmap is
+// created. The Secret holding its moved secrets is written before the API
+// server stores the configmap, when its uid is not known yet. Once the
+// configmap exists, the Secret is owned by it so that it is deleted with it.
+// A Secret whose configmap was never stored, e.g. because a later webhook
+// denied it, or was deleted before it was owned, is deleted.
+type MovedSecretReconciler struct {
+	clientset kubernetes.Interface
+	interval  time.Duration
+	log       zerolog.Logger
+}
+
+// NewMovedSecretReconciler creates a reconciler which checks the Secrets
+// every interval
+func NewMovedSecretReconciler(clientset kubernetes.Interface, interval time.Duration, log zerolog.Logger) *MovedSecretReconciler {
+	return &MovedSecretReconciler{
+		clientset: clientset,
+		interval:  interval,
+		log:       log,
+	}
+}
+
+// Run reconciles on start and then every interval until ctx is done
+func (r *MovedSecretReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.reconcile(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *MovedSecretReconciler) reconcile(ctx context.Context) {
+	list, err := r.clientset.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + movedSecretManager,
+	})
+	if err != nil {
+		r.log.Error().Err(err).Msg("failed when listing moved secrets")
+		return
+	}
+
+	for i := range list.Items {
+		secret := &list.Items[i]
+		if err := r.reconcileSecret(ctx, secret); err != nil {
+			r.log.Error().
+				Err(err).
+				Str("namespace", secret.Namespace).
+				Str("name", secret.Name).
+				Msg("failed when reconciling moved secret")
+		}
+	}
+}
+
+// reconcileSecret sets the owner of a Secret without one, or deletes the
+// Secret when its configmap does not exist after the grace period
+func (r *MovedSecretReconciler) reconcileSecret(ctx context.Context, secret *corev1.Secret) error {
+	name, ok := secret.Annotations[annotationMovedFrom]
+	if !ok || len(secret.OwnerReferences) > 0 {
+		return nil
+	}
+
+	client := r.clientset.CoreV1().Secrets(secret.Namespace)
+	configmap, err := r.clientset.CoreV1().ConfigMaps(secret.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if time.Since(secret.CreationTimestamp.Time) < movedSecretGracePeriod {
+			return nil
+		}
+		r.log.Info().
+			Str("namespace", secret.Namespace).
+			Str("name", secret.Name).
+			Str("configmap", name).
+			Msg("deleting moved secret whose configmap does not exist")
+		// the precondition keeps a Secret which was written in the meantime
+		return client.Delete(ctx, secret.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	secret.OwnerReferences = ownedBy(configmap)
+	_, err = client.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func movedSecret(name, configmap string, age time.Duration, owners ...metav1.OwnerReference) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:              name,
+		Namespace:         "app",
+		Labels:            map[string]string{managedByLabel: movedSecretManager},
+		Annotations:       map[string]string{annotationMovedFrom: configmap},
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		OwnerReferences:   owners,
+	}}
+}
+
+func TestMovedSecretReconcilerReconcile(t *testing.T) {
+	owner := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "gone", UID: "old"}
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app", UID: "web-uid"}},
+		movedSecret("web-satpolpp", "web", time.Hour),
+		movedSecret("denied-satpolpp", "denied", time.Hour),
+		movedSecret("pending-satpolpp", "pending", time.Minute),
+		movedSecret("gone-satpolpp", "gone", time.Hour, owner),
+	)
+	r := NewMovedSecretReconciler(clientset, time.Minute, zerolog.Nop())
+	r.reconcile(context.Background())
+
+	tests := []struct {
+		name    string
+		deleted bool
+		owner   types.UID
+	}{
+		// the configmap exists, so it owns its Secret
+		{name: "web-satpolpp", owner: "web-uid"},
+		// the configmap was never stored
+		{name: "denied-satpolpp", deleted: true},
+		// the configmap may still be admitted
+		{name: "pending-satpolpp"},
+		// the garbage collector deletes owned Secrets
+		{name: "gone-satpolpp", owner: "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := clientset.CoreV1().Secrets("app").Get(context.Background(), tt.name, metav1.GetOptions{})
+			if tt.deleted {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("secret is not deleted: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var owner types.UID
+			if len(secret.OwnerReferences) > 0 {
+				owner = secret.OwnerReferences[0].UID
+			}
+			if owner != tt.owner {
+				t.Errorf("owner is %q, want %q", owner, tt.owner)
+			}
+		})
+	}
+}
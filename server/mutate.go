@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/imrenagi/satpol-pp/server/agent"
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// movedSecretSuffix is added to the configmap name to name its Secret
+	movedSecretSuffix = "-satpolpp"
+	// annotationMovedFrom is the configmap whose secrets a Secret holds
+	annotationMovedFrom = "satpolpp.imrenagi.com/moved-from"
+	// movedSecretManager is the managed-by label of the Secrets
+	movedSecretManager = "satpol-pp"
+)
+
+// ConfigMapMutateHandler moves the secrets found in ConfigMaps into a
+// companion Secret, in the namespaces whose policy enables moveSecrets. Every
+// moved secret is reported in the warnings of the response.
+func (h *Handler) ConfigMapMutateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.handle(w, r, func(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			resp := h.mutateConfigMap(ctx, req)
+			observe(r.URL.Path, req, resp, nil)
+			return resp
+		})
+	}
+}
+
+// mutateConfigMap patches the configmap of the request so that each secret is
+// replaced by a placeholder, after storing the secrets in a Secret named after
+// the configmap. The Secret is also kept up to date on every update, even when
+// nothing is moved. Moving is best effort: the request is allowed unchanged
+// when it fails, and the validating webhook still checks the configmap.
+func (h *Handler) mutateConfigMap(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	reviewResponse := &admissionv1.AdmissionResponse{
+		Allowed: true,
+		UID:     req.UID,
+	}
+
+	var configmap corev1.ConfigMap
+	if err := json.Unmarshal(req.Object.Raw, &configmap); err != nil {
+		h.Log.Error().Err(err).Msg("could not unmarshal request to configmap")
+		return reviewResponse
+	}
+	if configmap.Namespace == "" {
+		configmap.Namespace = req.Namespace
+	}
+
+	if check, err := cm.ShouldCheck(configmap); err != nil || !check {
+		return reviewResponse
+	}
+	if strutil.StrListContains(kubeSystemNamespaces, req.Namespace) {
+		return reviewResponse
+	}
+
+	pol := h.Policies.For(req.Namespace)
+	if !pol.ConfigMap.MovesSecrets() || pol.Exempt(req.Kind.Kind, req.Namespace, configmap.Name) {
+		return reviewResponse
+	}
+	if configmap.Name == "" {
+		reviewResponse.Warnings = append(reviewResponse.Warnings, fmt.Sprintf("[%s] secrets are not moved from a configmap without a name", agent.RuleConfigMapSecret))
+		return reviewResponse
+	}
+
+	agents, err := h.agents.get(req.Namespace, pol)
+	if err != nil {
+		return h.moveFailed(reviewResponse, req, configmap.Name, err)
+	}
+
+	secretName := configmap.Name + movedSecretSuffix
+	mutated := configmap.DeepCopy()
+	values, moved, err := agents.configmap.MoveSecrets(ctx, mutated, secretName)
+	if err != nil {
+		return h.moveFailed(reviewResponse, req, configmap.Name, err)
+	}
+	if len(moved) == 0 && req.Operation != admissionv1.Update {
+		return reviewResponse
+	}
+
+	var patch []byte
+	if len(moved) > 0 {
+		if patch, err = configMapPatch(req.Object.Raw, mutated); err != nil {
+			return h.moveFailed(reviewResponse, req, configmap.Name, err)
+		}
+	}
+
+	// a dry run must not have side effects, so only the patch is returned
+	if req.DryRun == nil || !*req.DryRun {
+		if err := h.storeMovedSecrets(ctx, mutated, secretName, values); err != nil {
+			return h.moveFailed(reviewResponse, req, configmap.Name, err)
+		}
+	}
+	if len(moved) == 0 {
+		return reviewResponse
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	reviewResponse.Patch, reviewResponse.PatchType = patch, &patchType
+	for _, m := range moved {
+		h.Log.Info().
+			Str("namespace", req.Namespace).
+			Str("name", configmap.Name).
+			Str("field", m.Field).
+			Str("info_type", m.InfoType).
+			Str("secret", secretName).
+			Str("secret_key", m.SecretKey).
+			Msg("secret is moved out of configmap")
+		reviewResponse.Warnings = append(reviewResponse.Warnings, fmt.Sprintf("[%s] %s: %s was moved to Secret %s key %s",
+			agent.RuleConfigMapSecret, m.Location, m.InfoType, secretName, m.SecretKey))
+	}
+	return reviewResponse
+}
+
+// moveFailed allows the request unchanged, with a warning
+func (h *Handler) moveFailed(resp *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, name string, err error) *admissionv1.AdmissionResponse {
+	h.Log.Warn().
+		Err(err).
+		Str("namespace", req.Namespace).
+		Str("name", name).
+		Msg("secrets could not be moved out of configmap")
+	resp.Warnings = append(resp.Warnings, fmt.Sprintf("[%s] secrets could not be moved to a Secret: %s", agent.RuleConfigMapSecret, err))
+	return resp
+}
+
+// configMapPatch returns the json patch from the raw configmap to the data and
+// annotations of the mutated one. The raw object is patched as a map so that
+// fields unknown to this version of the api are kept.
+func configMapPatch(raw []byte, mutated *corev1.ConfigMap) ([]byte, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{}, len(mutated.Data))
+	for k, v := range mutated.Data {
+		data[k] = v
+	}
+	obj["data"] = data
+	if len(mutated.Annotations) > 0 {
+		metadata, ok := obj["metadata"].(map[string]interface{})
+		if !ok {
+			metadata = make(map[string]interface{})
+			obj["metadata"] = metadata
+		}
+		annotations := make(map[string]interface{}, len(mutated.Annotations))
+		for k, v := range mutated.Annotations {
+			annotations[k] = v
+		}
+		metadata["annotations"] = annotations
+	}
+
+	modified, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := jsonpatch.CreatePatch(raw, modified)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ops)
+}
+
+// storeMovedSecrets adds the values to the Secret of the configmap, creating
+// it when needed, and removes the keys which no placeholder of the configmap
+// refers to anymore. The uid of the configmap is only known from its first
+// update on, so the Secret is owned by the configmap from then on and deleted
+// with it. Until then, the MovedSecretReconciler sets the owner. A Secret of the same name which was not created by satpol-pp for
+// this configmap is never modified.
+func (h *Handler) storeMovedSecrets(ctx context.Context, configmap *corev1.ConfigMap, name string, values map[string]string) error {
+	client := h.Clientset.CoreV1().Secrets(configmap.Namespace)
+	secret, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if len(values) == 0 {
+			return nil
+		}
+		_, err = client.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       configmap.Namespace,
+				Labels:          map[string]string{managedByLabel: movedSecretManager},
+				Annotations:     map[string]string{annotationMovedFrom: configmap.Name},
+				OwnerReferences: ownedBy(configmap),
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: values,
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if secret.Labels[managedByLabel] != movedSecretManager || secret.Annotations[annotationMovedFrom] != configmap.Name {
+		return fmt.Errorf("secret %s already exists and is not managed by satpol-pp", name)
+	}
+	referenced := cm.PlaceholderKeys(configmap.Data, name)
+	data := make(map[string][]byte, len(referenced))
+	for k, v := range secret.Data {
+		if referenced[k] {
+			data[k] = v
+		}
+	}
+	for k, v := range values {
+		data[k] = []byte(v)
+	}
+	// on create, the owner of a Secret left by a deleted configmap of the same
+	// name is removed, so that the Secret is not garbage collected
+	owners := ownedBy(configmap)
+	if reflect.DeepEqual(data, secret.Data) && reflect.DeepEqual(owners, secret.OwnerReferences) {
+		return nil
+	}
+	secret.Data, secret.OwnerReferences = data, owners
+	_, err = client.Update(ctx, secret, metav1.UpdateOptions{})
+	return err
+}
+
+// ownedBy returns the owner reference to the configmap, or none while the
+// configmap is created and has no uid yet
+func ownedBy(configmap *corev1.ConfigMap) []metav1.OwnerReference {
+	if configmap.UID == "" {
+		return nil
+	}
+	return []metav1.OwnerReference{{
+		APIVersion: corev1.SchemeGroupVersion.String(),
+		Kind:       "ConfigMap",
+		Name:       configmap.Name,
+		UID:        configmap.UID,
+	}}
+}
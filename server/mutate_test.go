@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/imrenagi/satpol-pp/server/agent"
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// quoteDetector finds every occurrence of its quotes
+type quoteDetector []string
+
+func (d quoteDetector) Inspect(ctx context.Context, req cm.InspectRequest) ([]cm.Finding, error) {
+	var findings []cm.Finding
+	for _, quote := range d {
+		for at := 0; ; {
+			i := strings.Index(req.Text[at:], quote)
+			if i < 0 {
+				break
+			}
+			findings = append(findings, cm.Finding{InfoType: "PASSWORD", Quote: quote, Likelihood: cm.LikelihoodLikely, Offset: at + i})
+			at += i + len(quote)
+		}
+	}
+	return findings, nil
+}
+
+func (quoteDetector) Close() error { return nil }
+
+func newMoveHandler(objects ...runtime.Object) *Handler {
+	yes := true
+	return &Handler{
+		Policies:  policy.NewStore(&policy.Policy{ConfigMap: cm.AgentConfig{Detector: cm.DetectorOffline, MoveSecrets: &yes}}),
+		Log:       zerolog.Nop(),
+		Clientset: fake.NewSimpleClientset(objects...),
+		agents: agentCache{
+			detectors: map[detectorKey]cm.Detector{
+				{backend: cm.DetectorOffline}: quoteDetector{"hunter2!"},
+			},
+		},
+	}
+}
+
+func storedSecret(data map[string]string, owners ...metav1.OwnerReference) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app" + movedSecretSuffix,
+			Namespace:       "default",
+			Labels:          map[string]string{managedByLabel: movedSecretManager},
+			Annotations:     map[string]string{annotationMovedFrom: "app"},
+			OwnerReferences: owners,
+		},
+		Data: map[string][]byte{},
+	}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+func TestMutateConfigMapPatch(t *testing.T) {
+	const lastApplied = `{"apiVersion":"v1","data":{"app.properties":"password=hunter2!\nbackup=hunter2!\n"},"kind":"ConfigMap","metadata":{"annotations":{"note":"hunter2!"},"name":"app"}}` + "\n"
+	raw, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      "app",
+			"namespace": "default",
+			"annotations": map[string]string{
+				agent.AnnotationShouldCheck: "true",
+				"note":                      "hunter2!",
+				"kubectl.kubernetes.io/last-applied-configuration": lastApplied,
+			},
+		},
+		"data": map[string]string{
+			"app.properties": "password=hunter2!\nbackup=hunter2!\n",
+			"user":           "admin",
+		},
+		// unknown to this version of the api, so it must not be dropped
+		"immutableFields": []string{"user"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newMoveHandler()
+	resp := h.mutateConfigMap(context.Background(), &admissionv1.AdmissionRequest{
+		UID:       "1",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	})
+	if !resp.Allowed || resp.Patch == nil {
+		t.Fatalf("got allowed %v with patch %s, want a patch", resp.Allowed, resp.Patch)
+	}
+	if len(resp.Warnings) != 2 {
+		t.Errorf("got warnings %q, want one per moved secret", resp.Warnings)
+	}
+
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatalf("patch %s does not apply: %v", resp.Patch, err)
+	}
+	var obj struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Data            map[string]string `json:"data"`
+		ImmutableFields []string          `json:"immutableFields"`
+	}
+	if err := json.Unmarshal(patched, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := h.Clientset.CoreV1().Secrets("default").Get(context.Background(), "app"+movedSecretSuffix, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.StringData) != 1 {
+		t.Fatalf("got secret data %v, want the secret once", secret.StringData)
+	}
+	var placeholder string
+	for k, v := range secret.StringData {
+		if v != "hunter2!" {
+			t.Errorf("key %s holds %q, want the secret", k, v)
+		}
+		placeholder = cm.Placeholder(secret.Name, k)
+	}
+
+	wantData := map[string]string{
+		"app.properties": "password=" + placeholder + "\nbackup=" + placeholder + "\n",
+		"user":           "admin",
+	}
+	if !reflect.DeepEqual(obj.Data, wantData) {
+		t.Errorf("got data %q, want %q", obj.Data, wantData)
+	}
+	if !reflect.DeepEqual(obj.ImmutableFields, []string{"user"}) {
+		t.Errorf("got immutableFields %v, want them kept", obj.ImmutableFields)
+	}
+	if got := obj.Metadata.Annotations["note"]; got != "hunter2!" {
+		t.Errorf("got note %q, want it unchanged", got)
+	}
+	wantLastApplied := strings.Replace(lastApplied, `"password=hunter2!\nbackup=hunter2!\n"`, `"password=`+placeholder+`\nbackup=`+placeholder+`\n"`, 1)
+	if got := obj.Metadata.Annotations["kubectl.kubernetes.io/last-applied-configuration"]; got != wantLastApplied {
+		t.Errorf("got last-applied %s, want %s", got, wantLastApplied)
+	}
+}
+
+func TestStoreMovedSecrets(t *testing.T) {
+	configmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: types.UID("uid")},
+		Data: map[string]string{
+			"a": "password=" + cm.Placeholder("app"+movedSecretSuffix, "a-kept"),
+		},
+	}
+	owner := ownedBy(configmap)[0]
+
+	tests := []struct {
+		name     string
+		existing *corev1.Secret
+		values   map[string]string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "keys no placeholder refers to are pruned",
+			existing: storedSecret(map[string]string{"a-kept": "kept", "a-gone": "gone"}),
+			values:   map[string]string{"a-new": "new"},
+			want:     map[string]string{"a-kept": "kept", "a-new": "new"},
+		},
+		{
+			name:     "nothing moved",
+			existing: storedSecret(map[string]string{"a-kept": "kept", "a-gone": "gone"}, owner),
+			want:     map[string]string{"a-kept": "kept"},
+		},
+		{
+			name: "secret not managed by satpol-pp",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "app" + movedSecretSuffix, Namespace: "default"},
+				Data:       map[string][]byte{"a-kept": []byte("kept")},
+			},
+			values:  map[string]string{"a-new": "new"},
+			want:    map[string]string{"a-kept": "kept"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newMoveHandler(tt.existing)
+			err := h.storeMovedSecrets(context.Background(), configmap, "app"+movedSecretSuffix, tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			secret, err := h.Clientset.CoreV1().Secrets("default").Get(context.Background(), "app"+movedSecretSuffix, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string, len(secret.Data))
+			for k, v := range secret.Data {
+				got[k] = string(v)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got data %q, want %q", got, tt.want)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(secret.OwnerReferences, []metav1.OwnerReference{owner}) {
+				t.Errorf("got owners %v, want the configmap", secret.OwnerReferences)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ownerTTL is how long an owner is known to exist once it was looked up
+const ownerTTL = time.Minute
+
+// controllerUsers are the users which create the objects of each controller,
+// depending on whether the controller manager uses service account
+// credentials
+var controllerUsers = map[string][]string{
+	dep.KindDeployment:  {"system:serviceaccount:kube-system:deployment-controller"},
+	dep.KindReplicaSet:  {"system:serviceaccount:kube-system:replicaset-controller"},
+	dep.KindStatefulSet: {"system:serviceaccount:kube-system:statefulset-controller"},
+	dep.KindDaemonSet:   {"system:serviceaccount:kube-system:daemon-set-controller"},
+	dep.KindJob:         {"system:serviceaccount:kube-system:job-controller"},
+	dep.KindCronJob:     {"system:serviceaccount:kube-system:cronjob-controller"},
+}
+
+// controllerManagerUser is the user of the controllers without service
+// account credentials
+const controllerManagerUser = "system:kube-controller-manager"
+
+// ownerGroups is the api group of each workload which controls other ones
+var ownerGroups = map[string]string{
+	dep.KindDeployment:  "apps",
+	dep.KindReplicaSet:  "apps",
+	dep.KindStatefulSet: "apps",
+	dep.KindDaemonSet:   "apps",
+	dep.KindJob:         "batch",
+	dep.KindCronJob:     "batch",
+}
+
+// createdByController reports whether a workload, such as the pod of a
+// replicaset, is being created by the controller named in its owner
+// references. Its template was then already checked with the owner. The
+// owner references are written by whoever creates the object, so the owner
+// must exist with the same UID, and the user of the request, when known, must
+// be the controller itself.
+func (h *Handler) createdByController(ctx context.Context, namespace, user string, ref *metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if group, ok := ownerGroups[ref.Kind]; err != nil || !ok || gv.Group != group {
+		return false
+	}
+	if user != "" && user != controllerManagerUser && !strutil.StrListContains(controllerUsers[ref.Kind], user) {
+		return false
+	}
+	return h.ownerExists(ctx, namespace, ref)
+}
+
+// ownerExists looks the owner up. Owners which were found are remembered for
+// a while, as a controller usually creates several objects at once.
+func (h *Handler) ownerExists(ctx context.Context, namespace string, ref *metav1.OwnerReference) bool {
+	if h.Clientset == nil {
+		return false
+	}
+	key := namespace + "/" + ref.Kind + "/" + ref.Name + "/" + string(ref.UID)
+	if seen, ok := h.owners.Load(key); ok && time.Since(seen.(time.Time)) < ownerTTL {
+		return true
+	}
+
+	var (
+		owner metav1.Object
+		err   error
+	)
+	opts := metav1.GetOptions{}
+	switch ref.Kind {
+	case dep.KindDeployment:
+		owner, err = h.Clientset.AppsV1().Deployments(namespace).Get(ctx, ref.Name, opts)
+	case dep.KindReplicaSet:
+		owner, err = h.Clientset.AppsV1().ReplicaSets(namespace).Get(ctx, ref.Name, opts)
+	case dep.KindStatefulSet:
+		owner, err = h.Clientset.AppsV1().StatefulSets(namespace).Get(ctx, ref.Name, opts)
+	case dep.KindDaemonSet:
+		owner, err = h.Clientset.AppsV1().DaemonSets(namespace).Get(ctx, ref.Name, opts)
+	case dep.KindJob:
+		owner, err = h.Clientset.BatchV1().Jobs(namespace).Get(ctx, ref.Name, opts)
+	case dep.KindCronJob:
+		owner, err = h.Clientset.BatchV1beta1().CronJobs(namespace).Get(ctx, ref.Name, opts)
+	default:
+		return false
+	}
+	if err != nil {
+		h.Log.Debug().Err(err).Str("kind", ref.Kind).Str("name", ref.Name).Msg("owner could not be found")
+		return false
+	}
+	if owner.GetUID() != ref.UID {
+		return false
+	}
+	h.owners.Range(func(k, seen interface{}) bool {
+		if time.Since(seen.(time.Time)) >= ownerTTL {
+			h.owners.Delete(k)
+		}
+		return true
+	})
+	h.owners.Store(key, time.Now())
+	return true
+}
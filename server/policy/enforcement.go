@@ -0,0 +1,200 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+)
+
+// Action is what happens when a rule is violated
+type Action string
+
+// Actions which can be set for a rule
+const (
+	// ActionEnforce denies the request
+	ActionEnforce Action = "enforce"
+	// ActionWarn allows the request and returns the violations as warnings
+	ActionWarn Action = "warn"
+	// ActionAudit allows the request and only logs the violations
+	ActionAudit Action = "audit"
+)
+
+// ErrorAction is what happens when a rule can not be checked, e.g. because
+// Cloud DLP is unavailable
+type ErrorAction string
+
+// Actions which can be set for a rule which fails
+const (
+	// ErrorDeny denies the request. It fails closed.
+	ErrorDeny ErrorAction = "deny"
+	// ErrorAllow allows the request. It fails open.
+	ErrorAllow ErrorAction = "allow"
+	// ErrorWarn allows the request with a warning. It fails open.
+	ErrorWarn ErrorAction = "warn"
+)
+
+// Enforcement sets the action taken for each rule
+type Enforcement struct {
+	// Default is used for the rules which are not listed. It is enforce when
+	// it is not set.
+	Default Action `json:"default,omitempty"`
+	// Rules sets the action of a rule by its id
+	Rules map[string]Action `json:"rules,omitempty"`
+	// OnError sets what happens when a rule can not be checked by its id. The
+	// request is denied for the rules which are not listed, except for the
+	// workload-secret rule which only warns.
+	OnError map[string]ErrorAction `json:"onError,omitempty"`
+}
+
+// Merge returns a copy of e where the actions set in o win
+func (e Enforcement) Merge(o Enforcement) Enforcement {
+	merged := Enforcement{Default: e.Default}
+	if o.Default != "" {
+		merged.Default = o.Default
+	}
+	if len(e.Rules)+len(o.Rules) > 0 {
+		merged.Rules = make(map[string]Action, len(e.Rules)+len(o.Rules))
+	}
+	for rule, action := range e.Rules {
+		merged.Rules[rule] = action
+	}
+	for rule, action := range o.Rules {
+		merged.Rules[rule] = action
+	}
+	if len(e.OnError)+len(o.OnError) > 0 {
+		merged.OnError = make(map[string]ErrorAction, len(e.OnError)+len(o.OnError))
+	}
+	for rule, action := range e.OnError {
+		merged.OnError[rule] = action
+	}
+	for rule, action := range o.OnError {
+		merged.OnError[rule] = action
+	}
+	return merged
+}
+
+// Tighten returns a copy of e where the actions set in o only apply when they
+// are stricter than the ones of e. The default of o is the action of every
+// rule which o does not list.
+func (e Enforcement) Tighten(o Enforcement) Enforcement {
+	merged := e.Merge(Enforcement{})
+	for _, rule := range agent.Rules {
+		action, ok := o.Rules[rule]
+		if !ok {
+			action = o.Default
+		}
+		if actionRank[action] > actionRank[e.ActionFor(rule)] {
+			if merged.Rules == nil {
+				merged.Rules = make(map[string]Action, len(agent.Rules))
+			}
+			merged.Rules[rule] = action
+		}
+
+		if onError, ok := o.OnError[rule]; ok && errorActionRank[onError] > errorActionRank[e.OnErrorFor(rule)] {
+			if merged.OnError == nil {
+				merged.OnError = make(map[string]ErrorAction, len(agent.Rules))
+			}
+			merged.OnError[rule] = onError
+		}
+	}
+	return merged
+}
+
+// actionRank orders the actions from the least to the most strict, an unset
+// action being the least strict
+var actionRank = map[Action]int{
+	ActionAudit:   1,
+	ActionWarn:    2,
+	ActionEnforce: 3,
+}
+
+// errorActionRank orders the error actions from the least to the most strict
+var errorActionRank = map[ErrorAction]int{
+	ErrorAllow: 1,
+	ErrorWarn:  2,
+	ErrorDeny:  3,
+}
+
+// ActionFor returns the action of the rule
+func (e Enforcement) ActionFor(ruleID string) Action {
+	if action, ok := e.Rules[ruleID]; ok {
+		return action
+	}
+	if e.Default != "" {
+		return e.Default
+	}
+	return ActionEnforce
+}
+
+// defaultOnError is what happens when a rule which is not listed in OnError
+// can not be checked, deny when it is not set. Every workload write is
+// inspected for secrets, so an outage of the detector must not block them all.
+var defaultOnError = map[string]ErrorAction{
+	agent.RuleWorkloadSecret: ErrorWarn,
+}
+
+// OnErrorFor returns what happens when the rule can not be checked
+func (e Enforcement) OnErrorFor(ruleID string) ErrorAction {
+	if action, ok := e.OnError[ruleID]; ok {
+		return action
+	}
+	if action, ok := defaultOnError[ruleID]; ok {
+		return action
+	}
+	return ErrorDeny
+}
+
+func (e Enforcement) validate() []error {
+	var errs []error
+	if e.Default != "" && !validAction(e.Default) {
+		errs = append(errs, fmt.Errorf("enforcement.default: %q must be one of enforce, warn or audit", e.Default))
+	}
+	for _, rule := range sortedKeys(e.Rules) {
+		action := e.Rules[rule]
+		switch {
+		case !knownRule(rule):
+			errs = append(errs, fmt.Errorf("enforcement.rules.%s: unknown rule", rule))
+		case !validAction(action):
+			errs = append(errs, fmt.Errorf("enforcement.rules.%s: %q must be one of enforce, warn or audit", rule, action))
+		}
+	}
+
+	rules := make([]string, 0, len(e.OnError))
+	for rule := range e.OnError {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		action := e.OnError[rule]
+		switch {
+		case !knownRule(rule):
+			errs = append(errs, fmt.Errorf("enforcement.onError.%s: unknown rule", rule))
+		case action != ErrorDeny && action != ErrorAllow && action != ErrorWarn:
+			errs = append(errs, fmt.Errorf("enforcement.onError.%s: %q must be one of allow, deny or warn", rule, action))
+		}
+	}
+	return errs
+}
+
+func validAction(a Action) bool {
+	return a == ActionEnforce || a == ActionWarn || a == ActionAudit
+}
+
+func knownRule(rule string) bool {
+	for _, r := range agent.Rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]Action) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+)
+
+func TestActionFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		enforcement Enforcement
+		rule        string
+		want        Action
+	}{
+		{name: "unset", rule: agent.RuleRegistry, want: ActionEnforce},
+		{name: "default", enforcement: Enforcement{Default: ActionWarn}, rule: agent.RuleRegistry, want: ActionWarn},
+		{
+			name:        "rule",
+			enforcement: Enforcement{Rules: map[string]Action{agent.RuleProbe: ActionAudit}},
+			rule:        agent.RuleProbe,
+			want:        ActionAudit,
+		},
+		{
+			name:        "rule over default",
+			enforcement: Enforcement{Default: ActionAudit, Rules: map[string]Action{agent.RuleProbe: ActionEnforce}},
+			rule:        agent.RuleProbe,
+			want:        ActionEnforce,
+		},
+		{
+			name:        "default for another rule",
+			enforcement: Enforcement{Default: ActionAudit, Rules: map[string]Action{agent.RuleProbe: ActionEnforce}},
+			rule:        agent.RuleRegistry,
+			want:        ActionAudit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.enforcement.ActionFor(tt.rule); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnErrorFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		enforcement Enforcement
+		rule        string
+		want        ErrorAction
+	}{
+		{name: "unset", rule: agent.RuleConfigMapSecret, want: ErrorDeny},
+		{name: "workload secret warns", rule: agent.RuleWorkloadSecret, want: ErrorWarn},
+		{
+			name:        "workload secret set",
+			enforcement: Enforcement{OnError: map[string]ErrorAction{agent.RuleWorkloadSecret: ErrorDeny}},
+			rule:        agent.RuleWorkloadSecret,
+			want:        ErrorDeny,
+		},
+		{
+			name:        "allow",
+			enforcement: Enforcement{OnError: map[string]ErrorAction{agent.RuleConfigMapSecret: ErrorAllow}},
+			rule:        agent.RuleConfigMapSecret,
+			want:        ErrorAllow,
+		},
+		{
+			name:        "another rule",
+			enforcement: Enforcement{OnError: map[string]ErrorAction{agent.RuleConfigMapSecret: ErrorAllow}},
+			rule:        agent.RuleRegistry,
+			want:        ErrorDeny,
+		},
+		{
+			name:        "default action does not apply",
+			enforcement: Enforcement{Default: ActionAudit},
+			rule:        agent.RuleConfigMapSecret,
+			want:        ErrorDeny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.enforcement.OnErrorFor(tt.rule); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
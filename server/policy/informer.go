@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Informer keeps the SatpolPolicy and SatpolNamespacePolicy objects of the
+// cluster in sync with a Store.
+type Informer struct {
+	store   *Store
+	factory dynamicinformer.DynamicSharedInformerFactory
+}
+
+// NewInformer creates an Informer which watches the policy objects with the
+// given client.
+func NewInformer(client dynamic.Interface, store *Store, resync time.Duration) *Informer {
+	i := &Informer{
+		store:   store,
+		factory: dynamicinformer.NewDynamicSharedInformerFactory(client, resync),
+	}
+
+	i.factory.ForResource(SatpolPolicyResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    i.setClusterPolicy,
+		UpdateFunc: func(_, obj interface{}) { i.setClusterPolicy(obj) },
+		DeleteFunc: i.deleteClusterPolicy,
+	})
+	i.factory.ForResource(SatpolNamespacePolicyResource).Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    i.setNamespacePolicy,
+		UpdateFunc: func(_, obj interface{}) { i.setNamespacePolicy(obj) },
+		DeleteFunc: i.deleteNamespacePolicy,
+	})
+	return i
+}
+
+// Run starts watching and blocks until ctx is done
+func (i *Informer) Run(ctx context.Context) {
+	i.factory.Start(ctx.Done())
+	for resource, ok := range i.factory.WaitForCacheSync(ctx.Done()) {
+		if !ok {
+			log.Error().Str("resource", resource.Resource).Msg("unable to sync policy informer")
+			continue
+		}
+		log.Info().Str("resource", resource.Resource).Msg("policy informer synced")
+	}
+	<-ctx.Done()
+}
+
+func (i *Informer) setClusterPolicy(obj interface{}) {
+	var p SatpolPolicy
+	if err := fromUnstructured(obj, &p); err != nil {
+		log.Error().Err(err).Msg("unable to decode SatpolPolicy")
+		return
+	}
+
+	if err := i.store.SetClusterPolicy(p.Name, &p.Spec); err != nil {
+		log.Error().Err(err).Msg("ignoring SatpolPolicy")
+		return
+	}
+	log.Info().Str("name", p.Name).Msg("SatpolPolicy updated")
+}
+
+func (i *Informer) deleteClusterPolicy(obj interface{}) {
+	_, name, err := objectKey(obj)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to get key of deleted SatpolPolicy")
+		return
+	}
+
+	i.store.DeleteClusterPolicy(name)
+	log.Info().Str("name", name).Msg("SatpolPolicy deleted")
+}
+
+func (i *Informer) setNamespacePolicy(obj interface{}) {
+	var p SatpolNamespacePolicy
+	if err := fromUnstructured(obj, &p); err != nil {
+		log.Error().Err(err).Msg("unable to decode SatpolNamespacePolicy")
+		return
+	}
+
+	if err := i.store.SetNamespacePolicy(p.Namespace, p.Name, &p.Spec); err != nil {
+		log.Error().Err(err).Msg("ignoring SatpolNamespacePolicy")
+		return
+	}
+	log.Info().Str("namespace", p.Namespace).Str("name", p.Name).Msg("SatpolNamespacePolicy updated")
+}
+
+func (i *Informer) deleteNamespacePolicy(obj interface{}) {
+	namespace, name, err := objectKey(obj)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to get key of deleted SatpolNamespacePolicy")
+		return
+	}
+
+	i.store.DeleteNamespacePolicy(namespace, name)
+	log.Info().Str("namespace", namespace).Str("name", name).Msg("SatpolNamespacePolicy deleted")
+}
+
+func fromUnstructured(obj interface{}, into interface{}) error {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T", obj)
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), into)
+}
+
+func objectKey(obj interface{}) (namespace, name string, err error) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return "", "", err
+	}
+	return cache.SplitMetaNamespaceKey(key)
+}
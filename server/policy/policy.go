@@ -0,0 +1,181 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/redact"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy holds the configuration of every agent used by the admission
+// webhook. It is usually loaded from the file given to the `--policy-file` flag.
+type Policy struct {
+	Deployment dep.AgentConfig `json:"deployment,omitempty"`
+	ConfigMap  cm.AgentConfig  `json:"configmap,omitempty"`
+	Exemptions []Exemption     `json:"exemptions,omitempty"`
+
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+}
+
+// Exemption excludes the matching objects from every check. An empty field
+// matches everything, and each value may be a shell pattern such as `legacy-*`.
+type Exemption struct {
+	Kinds      []string `json:"kinds,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	Names      []string `json:"names,omitempty"`
+}
+
+func (e Exemption) matches(kind, namespace, name string) bool {
+	return matchAny(e.Kinds, kind) &&
+		matchAny(e.Namespaces, namespace) &&
+		matchAny(e.Names, name)
+}
+
+func (e Exemption) validate(field string) []error {
+	if len(e.Kinds) == 0 && len(e.Namespaces) == 0 && len(e.Names) == 0 {
+		return []error{fmt.Errorf("%s: at least one of kinds, namespaces or names must be set", field)}
+	}
+
+	var errs []error
+	errs = append(errs, validatePatterns(field+".kinds", e.Kinds)...)
+	errs = append(errs, validatePatterns(field+".namespaces", e.Namespaces)...)
+	errs = append(errs, validatePatterns(field+".names", e.Names)...)
+	return errs
+}
+
+func validatePatterns(field string, patterns []string) []error {
+	var errs []error
+	for i, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %q is not a valid pattern", field, i, pattern))
+		}
+	}
+	return errs
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads and validates the policy stored in the given YAML file
+func Load(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file %s: %w", path, err)
+	}
+
+	p, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Parse decodes a YAML (or JSON) document into a Policy. Unknown fields are
+// rejected so that a typo does not silently disable a rule.
+func Parse(b []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Validate checks that all the required fields are set and well formed
+func (p *Policy) Validate() error {
+	var errs []string
+	for _, err := range p.Deployment.Validate() {
+		errs = append(errs, "deployment."+err.Error())
+	}
+	for _, err := range p.ConfigMap.Validate() {
+		errs = append(errs, "configmap."+err.Error())
+	}
+	for _, err := range p.Enforcement.validate() {
+		errs = append(errs, err.Error())
+	}
+	for i, exemption := range p.Exemptions {
+		for _, err := range exemption.validate(fmt.Sprintf("exemptions[%d]", i)) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Merge returns a new policy where o is applied on top of p. See the Merge
+// method of each agent config for how their fields are combined. Exemptions of
+// both policies apply, and the enforcement actions set in o win.
+func (p *Policy) Merge(o *Policy) *Policy {
+	merged := &Policy{
+		Deployment:  p.Deployment.Merge(o.Deployment),
+		ConfigMap:   p.ConfigMap.Merge(o.ConfigMap),
+		Enforcement: p.Enforcement.Merge(o.Enforcement),
+	}
+	merged.Exemptions = append(merged.Exemptions, p.Exemptions...)
+	merged.Exemptions = append(merged.Exemptions, o.Exemptions...)
+	return merged
+}
+
+// MergeNamespaced returns a new policy where the SatpolNamespacePolicy o is
+// applied on top of p. It is merged like Merge, except that the enforcement
+// actions of o only apply when they are stricter, so that a namespace can not
+// weaken the rules of the cluster.
+func (p *Policy) MergeNamespaced(o *Policy) *Policy {
+	merged := p.Merge(o)
+	merged.Enforcement = p.Enforcement.Tighten(o.Enforcement)
+	return merged
+}
+
+// validateNamespaced checks that a SatpolNamespacePolicy only sets the fields
+// which a namespace may set. Exemptions and the way secrets are detected and
+// censored can only be set by the policy file and SatpolPolicy objects.
+func (p *Policy) validateNamespaced() error {
+	var errs []string
+	if len(p.Exemptions) > 0 {
+		errs = append(errs, "exemptions: can only be set cluster wide")
+	}
+	if p.ConfigMap.Detector != "" {
+		errs = append(errs, "configmap.detector: can only be set cluster wide")
+	}
+	if p.ConfigMap.GoogleProjectID != "" {
+		errs = append(errs, "configmap.googleProjectID: can only be set cluster wide")
+	}
+	if p.ConfigMap.Censor != (redact.Censor{}) {
+		errs = append(errs, "configmap.censor: can only be set cluster wide")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Exempt reports whether the object is excluded from every check
+func (p *Policy) Exempt(kind, namespace, name string) bool {
+	for _, e := range p.Exemptions {
+		if e.matches(kind, namespace, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Store holds the policy file together with the policy objects found in the
+// cluster, and merges them into the effective policy of each namespace.
+//
+// Readers never block: every change builds a new snapshot which is swapped
+// atomically, so a request keeps the policy it started with.
+type Store struct {
+	// mu serializes writers
+	mu       sync.Mutex
+	snapshot atomic.Value
+}
+
+type snapshot struct {
+	base       *Policy
+	cluster    map[string]*Policy
+	namespaced map[string]map[string]*Policy
+
+	// effective caches the merged policy of each namespace
+	effective sync.Map
+}
+
+// NewStore creates a Store using base as the policy file
+func NewStore(base *Policy) *Store {
+	s := &Store{}
+	s.snapshot.Store(&snapshot{
+		base:       base,
+		cluster:    map[string]*Policy{},
+		namespaced: map[string]map[string]*Policy{},
+	})
+	return s
+}
+
+// For returns the effective policy of the namespace. It is the policy file,
+// then every SatpolPolicy and finally every SatpolNamespacePolicy of the
+// namespace merged on top of each other, ordered by name. A
+// SatpolNamespacePolicy can only make the enforcement actions stricter.
+func (s *Store) For(namespace string) *Policy {
+	snap := s.load()
+	if p, ok := snap.effective.Load(namespace); ok {
+		return p.(*Policy)
+	}
+
+	p := snap.merge(namespace, "", nil)
+	snap.effective.Store(namespace, p)
+	return p
+}
+
+// SetBase replaces the policy file
+func (s *Store) SetBase(p *Policy) {
+	s.update(func(next *snapshot) {
+		next.base = p
+	})
+}
+
+// SetClusterPolicy adds or replaces a SatpolPolicy. The policy is rejected if
+// the result of merging it with the policy file and every other SatpolPolicy
+// is not valid.
+func (s *Store) SetClusterPolicy(name string, p *Policy) error {
+	if err := s.load().mergeCluster(name, p).Validate(); err != nil {
+		return fmt.Errorf("invalid SatpolPolicy %s: %w", name, err)
+	}
+
+	s.update(func(next *snapshot) {
+		next.cluster = copyPolicies(next.cluster)
+		next.cluster[name] = p
+	})
+	return nil
+}
+
+// DeleteClusterPolicy removes a SatpolPolicy
+func (s *Store) DeleteClusterPolicy(name string) {
+	s.update(func(next *snapshot) {
+		next.cluster = copyPolicies(next.cluster)
+		delete(next.cluster, name)
+	})
+}
+
+// SetNamespacePolicy adds or replaces a SatpolNamespacePolicy. The policy is
+// rejected if it sets a field which can only be set cluster wide, or if the
+// result of merging it with the effective policy of the namespace is not
+// valid.
+func (s *Store) SetNamespacePolicy(namespace, name string, p *Policy) error {
+	if err := p.validateNamespaced(); err != nil {
+		return fmt.Errorf("invalid SatpolNamespacePolicy %s/%s: %w", namespace, name, err)
+	}
+	if err := s.load().merge(namespace, name, p).Validate(); err != nil {
+		return fmt.Errorf("invalid SatpolNamespacePolicy %s/%s: %w", namespace, name, err)
+	}
+
+	s.update(func(next *snapshot) {
+		next.namespaced = copyNamespaced(next.namespaced)
+		next.namespaced[namespace] = copyPolicies(next.namespaced[namespace])
+		next.namespaced[namespace][name] = p
+	})
+	return nil
+}
+
+// DeleteNamespacePolicy removes a SatpolNamespacePolicy
+func (s *Store) DeleteNamespacePolicy(namespace, name string) {
+	s.update(func(next *snapshot) {
+		next.namespaced = copyNamespaced(next.namespaced)
+		next.namespaced[namespace] = copyPolicies(next.namespaced[namespace])
+		delete(next.namespaced[namespace], name)
+		if len(next.namespaced[namespace]) == 0 {
+			delete(next.namespaced, namespace)
+		}
+	})
+}
+
+func (s *Store) load() *snapshot {
+	return s.snapshot.Load().(*snapshot)
+}
+
+func (s *Store) update(fn func(next *snapshot)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.load()
+	next := &snapshot{
+		base:       prev.base,
+		cluster:    prev.cluster,
+		namespaced: prev.namespaced,
+	}
+	fn(next)
+	s.snapshot.Store(next)
+}
+
+// mergeCluster builds the policy of every namespace before its
+// SatpolNamespacePolicy objects are applied. When name is set, p is used in
+// place of the SatpolPolicy with that name.
+func (snap *snapshot) mergeCluster(name string, p *Policy) *Policy {
+	policies := snap.cluster
+	if name != "" {
+		policies = copyPolicies(policies)
+		policies[name] = p
+	}
+
+	effective := snap.base
+	for _, n := range sortedNames(policies) {
+		effective = effective.Merge(policies[n])
+	}
+	return effective
+}
+
+// merge builds the effective policy of the namespace. When name is set, p is
+// used in place of the SatpolNamespacePolicy with that name.
+func (snap *snapshot) merge(namespace, name string, p *Policy) *Policy {
+	effective := snap.mergeCluster("", nil)
+
+	policies := snap.namespaced[namespace]
+	if name != "" {
+		policies = copyPolicies(policies)
+		policies[name] = p
+	}
+	for _, n := range sortedNames(policies) {
+		effective = effective.MergeNamespaced(policies[n])
+	}
+	return effective
+}
+
+func sortedNames(policies map[string]*Policy) []string {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func copyPolicies(m map[string]*Policy) map[string]*Policy {
+	c := make(map[string]*Policy, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyNamespaced(m map[string]map[string]*Policy) map[string]map[string]*Policy {
+	c := make(map[string]map[string]*Policy, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	cm "github.com/imrenagi/satpol-pp/server/agent/configmap"
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/redact"
+)
+
+func testBase() *Policy {
+	return &Policy{
+		Deployment: dep.AgentConfig{ImageRegistries: []string{"gcr.io/distroless"}},
+		ConfigMap:  cm.AgentConfig{Detector: cm.DetectorOffline},
+		Enforcement: Enforcement{
+			Rules: map[string]Action{agent.RuleProbe: ActionWarn},
+		},
+	}
+}
+
+func TestStoreNamespacePolicyEnforcement(t *testing.T) {
+	tests := []struct {
+		name        string
+		enforcement Enforcement
+		want        map[string]Action
+		wantOnError map[string]ErrorAction
+	}{
+		{
+			name:        "default can not loosen",
+			enforcement: Enforcement{Default: ActionAudit},
+			want: map[string]Action{
+				agent.RuleRegistry:        ActionEnforce,
+				agent.RuleProbe:           ActionWarn,
+				agent.RuleConfigMapSecret: ActionEnforce,
+			},
+		},
+		{
+			name:        "default tightens",
+			enforcement: Enforcement{Default: ActionEnforce},
+			want:        map[string]Action{agent.RuleProbe: ActionEnforce},
+		},
+		{
+			name:        "rule can not loosen",
+			enforcement: Enforcement{Rules: map[string]Action{agent.RuleRegistry: ActionAudit, agent.RuleProbe: ActionAudit}},
+			want:        map[string]Action{agent.RuleRegistry: ActionEnforce, agent.RuleProbe: ActionWarn},
+		},
+		{
+			name: "onError",
+			enforcement: Enforcement{OnError: map[string]ErrorAction{
+				agent.RuleConfigMapSecret: ErrorAllow,
+				agent.RuleWorkloadSecret:  ErrorDeny,
+			}},
+			wantOnError: map[string]ErrorAction{
+				agent.RuleConfigMapSecret: ErrorDeny,
+				agent.RuleWorkloadSecret:  ErrorDeny,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(testBase())
+			if err := s.SetNamespacePolicy("team", "p", &Policy{Enforcement: tt.enforcement}); err != nil {
+				t.Fatal(err)
+			}
+			p := s.For("team")
+			for rule, want := range tt.want {
+				if got := p.Enforcement.ActionFor(rule); got != want {
+					t.Errorf("rule %s is %s, want %s", rule, got, want)
+				}
+			}
+			for rule, want := range tt.wantOnError {
+				if got := p.Enforcement.OnErrorFor(rule); got != want {
+					t.Errorf("onError of rule %s is %s, want %s", rule, got, want)
+				}
+			}
+			if got := s.For("other").Enforcement.ActionFor(agent.RuleProbe); got != ActionWarn {
+				t.Errorf("rule probe of another namespace is %s, want warn", got)
+			}
+		})
+	}
+}
+
+func TestStoreNamespacePolicyClusterFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{name: "exemptions", policy: Policy{Exemptions: []Exemption{{Names: []string{"*"}}}}},
+		{name: "detector", policy: Policy{ConfigMap: cm.AgentConfig{Detector: cm.DetectorOffline}}},
+		{name: "googleProjectID", policy: Policy{ConfigMap: cm.AgentConfig{GoogleProjectID: "my-project"}}},
+		{name: "censor", policy: Policy{ConfigMap: cm.AgentConfig{Censor: redact.Censor{Mode: "hash"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(testBase())
+			if err := s.SetNamespacePolicy("team", "p", &tt.policy); err == nil {
+				t.Error("want an error")
+			}
+			if !reflect.DeepEqual(s.For("team"), s.For("other")) {
+				t.Error("want the policy to be ignored")
+			}
+		})
+	}
+}
+
+func TestStoreClusterPolicyValidatesAll(t *testing.T) {
+	s := NewStore(testBase())
+	dlp := &Policy{ConfigMap: cm.AgentConfig{Detector: cm.DetectorDLP}}
+	// dlp is only valid together with a policy which sets the project
+	if err := s.SetClusterPolicy("dlp", dlp); err == nil {
+		t.Error("want an error when no policy sets googleProjectID")
+	}
+	if err := s.SetClusterPolicy("project", &Policy{ConfigMap: cm.AgentConfig{GoogleProjectID: "my-project"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetClusterPolicy("dlp", dlp); err != nil {
+		t.Errorf("want no error once googleProjectID is set, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package policy
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the api group of the policy custom resources
+const GroupName = "satpolpp.imrenagi.com"
+
+var (
+	// SchemeGroupVersion is the group version of the policy custom resources
+	SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+	// SatpolPolicyResource is the cluster scoped policy resource
+	SatpolPolicyResource = SchemeGroupVersion.WithResource("satpolpolicies")
+	// SatpolNamespacePolicyResource is the namespaced policy resource
+	SatpolNamespacePolicyResource = SchemeGroupVersion.WithResource("satpolnamespacepolicies")
+)
+
+// SatpolPolicy is a cluster scoped policy. It applies to every namespace on
+// top of the policy file.
+type SatpolPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Policy `json:"spec"`
+}
+
+// SatpolNamespacePolicy is a policy which only applies to its own namespace,
+// on top of the policy file and all SatpolPolicy objects. It can only make the
+// enforcement actions stricter, and can not set the fields reserved to the
+// cluster.
+type SatpolNamespacePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Policy `json:"spec"`
+}
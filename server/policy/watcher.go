@@ -0,0 +1,99 @@
+package policy
+
+import (
+	"context"
+	"time"
+
+	"github.com/radovskyb/watcher"
+	"github.com/rs/zerolog/log"
+)
+
+// maxRewatchBackoff is the longest wait between two attempts to watch a
+// deleted policy file again
+const maxRewatchBackoff = 30 * time.Second
+
+// Watcher polls the policy file and hands every successfully loaded policy to
+// a callback. A file which fails to load is logged and skipped so the last
+// good policy stays in effect. A deleted file is watched again, with a backoff,
+// as soon as it exists again.
+type Watcher struct {
+	path     string
+	interval time.Duration
+	fn       func(*Policy)
+}
+
+// NewWatcher creates a Watcher for the policy file in the given path. fn is
+// called from the watcher goroutine each time the file changes.
+func NewWatcher(path string, interval time.Duration, fn func(*Policy)) *Watcher {
+	return &Watcher{
+		path:     path,
+		interval: interval,
+		fn:       fn,
+	}
+}
+
+// Run blocks until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	fw := watcher.New()
+	fw.SetMaxEvents(1)
+	defer fw.Close()
+
+	if err := fw.Add(w.path); err != nil {
+		log.Error().Err(err).Str("path", w.path).Msg("unable to watch policy file")
+		return
+	}
+
+	go func() {
+		if err := fw.Start(w.interval); err != nil {
+			log.Error().Err(err).Str("path", w.path).Msg("unable to start policy file watcher")
+		}
+	}()
+
+	// rewatch fires when the deleted file should be watched again
+	var (
+		rewatch <-chan time.Time
+		backoff time.Duration
+	)
+	for {
+		select {
+		case event := <-fw.Event:
+			log.Debug().Str("op", event.Op.String()).Str("path", w.path).Msg("policy file changed")
+			w.reload()
+		case err := <-fw.Error:
+			log.Error().Err(err).Str("path", w.path).Msg("error watching policy file")
+			if err == watcher.ErrWatchedFileDeleted && rewatch == nil {
+				// the file is replaced rather than modified when it is mounted
+				// from a ConfigMap, so start watching the new one once it
+				// exists.
+				backoff = w.interval
+				rewatch = time.After(backoff)
+			}
+		case <-rewatch:
+			if err := fw.Add(w.path); err != nil {
+				backoff *= 2
+				if backoff > maxRewatchBackoff {
+					backoff = maxRewatchBackoff
+				}
+				log.Warn().Err(err).Str("path", w.path).Dur("retry_in", backoff).Msg("unable to watch policy file again")
+				rewatch = time.After(backoff)
+				continue
+			}
+			rewatch = nil
+			log.Info().Str("path", w.path).Msg("watching policy file again")
+			// the new file is not reported as a change
+			w.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	p, err := Load(w.path)
+	if err != nil {
+		log.Error().Err(err).Msg("unable to reload policy, keeping the previous one")
+		return
+	}
+	log.Info().Str("path", w.path).Msg("policy reloaded")
+	w.fn(p)
+}
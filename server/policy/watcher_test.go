@@ -0,0 +1,54 @@
+package policy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePolicy(t *testing.T, path, registry string) {
+	t.Helper()
+	b := []byte("deployment:\n  imageRegistries:\n  - " + registry + "\nconfigmap:\n  detector: offline\n")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherRewatchesDeletedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yaml")
+	writePolicy(t, path, "gcr.io/old")
+
+	loaded := make(chan *Policy, 10)
+	w := NewWatcher(path, 10*time.Millisecond, func(p *Policy) { loaded <- p })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	// the file is missing for a few attempts before it is replaced
+	time.Sleep(100 * time.Millisecond)
+	writePolicy(t, path, "gcr.io/new")
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-loaded:
+			if p.Deployment.ImageRegistries[0] == "gcr.io/new" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("the replaced policy file was not loaded")
+		}
+	}
+}
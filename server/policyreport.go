@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// PolicyReportResource is the PolicyReport of the Kubernetes Policy WG
+var PolicyReportResource = schema.GroupVersionResource{Group: "wgpolicyk8s.io", Version: "v1alpha2", Resource: "policyreports"}
+
+const (
+	// policyReportName is the name of the report written in each namespace
+	policyReportName = "satpol-pp"
+	// policyReportSource is the source of every result in the reports
+	policyReportSource = "satpol-pp"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+)
+
+// Results of a rule in a PolicyReport
+const (
+	reportPass = "pass"
+	reportFail = "fail"
+	reportWarn = "warn"
+)
+
+// reportedResource is an object and how it was last evaluated
+type reportedResource struct {
+	ref       metav1.GroupVersionKind
+	name      string
+	uid       types.UID
+	eval      *Evaluation
+	timestamp time.Time
+}
+
+// PolicyReporter writes the results of the audit and of the admission requests
+// as one PolicyReport per namespace. A complete audit scan replaces every
+// result, so objects which were fixed or deleted since disappear from the
+// reports. The reports written before a restart are replaced by the first
+// scan too.
+type PolicyReporter struct {
+	client   dynamic.Interface
+	interval time.Duration
+	log      zerolog.Logger
+
+	mu sync.Mutex
+	// resources of each namespace by kind and name
+	resources map[string]map[string]reportedResource
+	// dirty are the namespaces whose report has to be written
+	dirty map[string]bool
+	// existing are the namespaces which had a report when the reporter
+	// started, until the first scan replaces them
+	existing map[string]bool
+}
+
+// NewPolicyReporter creates a reporter which writes the changed reports every
+// interval
+func NewPolicyReporter(client dynamic.Interface, interval time.Duration, log zerolog.Logger) *PolicyReporter {
+	return &PolicyReporter{
+		client:    client,
+		interval:  interval,
+		log:       log,
+		resources: make(map[string]map[string]reportedResource),
+		dirty:     make(map[string]bool),
+		existing:  make(map[string]bool),
+	}
+}
+
+// SetAuditResults replaces all the results with the ones of a complete scan
+func (r *PolicyReporter) SetAuditResults(results []AuditResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for namespace := range r.resources {
+		r.dirty[namespace] = true
+	}
+	for namespace := range r.existing {
+		r.dirty[namespace] = true
+	}
+	r.resources = make(map[string]map[string]reportedResource)
+	r.existing = make(map[string]bool)
+
+	now := time.Now()
+	for _, result := range results {
+		if result.Evaluation == nil {
+			continue
+		}
+		r.set(result.Namespace, reportedResource{
+			ref:       result.Kind,
+			name:      result.Name,
+			uid:       result.UID,
+			eval:      result.Evaluation,
+			timestamp: now,
+		})
+	}
+}
+
+// Record updates the results of the object of an admission request. It can be
+// registered with Handler.OnReview.
+func (r *PolicyReporter) Record(req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *Evaluation) {
+	// a denied object is not persisted, so it does not belong in the report
+	if !resp.Allowed || req.SubResource != "" {
+		return
+	}
+
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil || obj.Name == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := resourceKey(req.Kind, obj.Name)
+	if eval == nil {
+		if _, ok := r.resources[req.Namespace][key]; ok {
+			delete(r.resources[req.Namespace], key)
+			r.dirty[req.Namespace] = true
+		}
+		return
+	}
+	r.set(req.Namespace, reportedResource{
+		ref:       req.Kind,
+		name:      obj.Name,
+		uid:       obj.UID,
+		eval:      eval,
+		timestamp: time.Now(),
+	})
+}
+
+// set must be called with r.mu held
+func (r *PolicyReporter) set(namespace string, res reportedResource) {
+	if r.resources[namespace] == nil {
+		r.resources[namespace] = make(map[string]reportedResource)
+	}
+	r.resources[namespace][resourceKey(res.ref, res.name)] = res
+	r.dirty[namespace] = true
+}
+
+// Run writes the changed reports every interval until ctx is done
+func (r *PolicyReporter) Run(ctx context.Context) {
+	r.loadExisting(ctx)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadExisting remembers the namespaces of the reports written before, so
+// that the first scan also deletes the ones which have no results anymore
+func (r *PolicyReporter) loadExisting(ctx context.Context) {
+	list, err := r.client.Resource(PolicyReportResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + policyReportSource,
+	})
+	if err != nil {
+		r.log.Error().Err(err).Msg("failed when listing existing policy reports")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, report := range list.Items {
+		if report.GetName() == policyReportName {
+			r.existing[report.GetNamespace()] = true
+		}
+	}
+}
+
+// flush writes the report of every dirty namespace. Reports which fail to be
+// written stay dirty and are retried on the next flush.
+func (r *PolicyReporter) flush(ctx context.Context) {
+	r.mu.Lock()
+	reports := make(map[string]*unstructured.Unstructured, len(r.dirty))
+	for namespace := range r.dirty {
+		reports[namespace] = r.report(namespace)
+	}
+	r.dirty = make(map[string]bool)
+	r.mu.Unlock()
+
+	for namespace, report := range reports {
+		if err := r.write(ctx, namespace, report); err != nil {
+			r.log.Error().Err(err).Str("namespace", namespace).Msg("failed when writing policy report")
+			r.mu.Lock()
+			r.dirty[namespace] = true
+			r.mu.Unlock()
+		}
+	}
+}
+
+// write creates or updates the report of the namespace, or deletes it when it
+// has no results
+func (r *PolicyReporter) write(ctx context.Context, namespace string, report *unstructured.Unstructured) error {
+	client := r.client.Resource(PolicyReportResource).Namespace(namespace)
+	if report == nil {
+		err := client.Delete(ctx, policyReportName, metav1.DeleteOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	existing, err := client.Get(ctx, policyReportName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, report, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	report.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(ctx, report, metav1.UpdateOptions{})
+	return err
+}
+
+// report builds the PolicyReport of the namespace, or returns nil when the
+// namespace has no results. It must be called with r.mu held.
+func (r *PolicyReporter) report(namespace string) *unstructured.Unstructured {
+	resources := r.resources[namespace]
+	if len(resources) == 0 {
+		delete(r.resources, namespace)
+		return nil
+	}
+
+	keys := make([]string, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	summary := map[string]interface{}{"pass": int64(0), "fail": int64(0), "warn": int64(0), "error": int64(0), "skip": int64(0)}
+	var results []interface{}
+	for _, key := range keys {
+		res := resources[key]
+		for _, ruleID := range res.eval.Rules {
+			result, entry := policyReportResult(namespace, res, ruleID)
+			summary[result] = summary[result].(int64) + 1
+			results = append(results, entry)
+		}
+	}
+
+	report := &unstructured.Unstructured{Object: map[string]interface{}{
+		"summary": summary,
+		"results": results,
+	}}
+	report.SetAPIVersion(PolicyReportResource.GroupVersion().String())
+	report.SetKind("PolicyReport")
+	report.SetName(policyReportName)
+	report.SetNamespace(namespace)
+	report.SetLabels(map[string]string{managedByLabel: policyReportSource})
+	return report
+}
+
+// policyReportResult is the result of one rule for one object. Enforced and
+// audited violations fail, warned ones warn.
+func policyReportResult(namespace string, res reportedResource, ruleID string) (string, map[string]interface{}) {
+	result, message := reportPass, agent.RuleDescriptions[ruleID]
+	properties := map[string]interface{}{}
+	if action := res.eval.Action(ruleID); action != "" {
+		result = reportFail
+		if action == policy.ActionWarn {
+			result = reportWarn
+		}
+
+		var messages, fields []string
+		for _, d := range res.eval.Decisions {
+			if d.RuleID == ruleID {
+				messages = append(messages, d.Message)
+				if d.Field != "" {
+					fields = append(fields, d.Field)
+				}
+			}
+		}
+		message = strings.Join(messages, "; ")
+		properties["action"] = string(action)
+		if len(fields) > 0 {
+			properties["fields"] = strings.Join(fields, ",")
+		}
+	}
+
+	resource := map[string]interface{}{
+		"apiVersion": schema.GroupVersion{Group: res.ref.Group, Version: res.ref.Version}.String(),
+		"kind":       res.ref.Kind,
+		"namespace":  namespace,
+		"name":       res.name,
+	}
+	if res.uid != "" {
+		resource["uid"] = string(res.uid)
+	}
+
+	entry := map[string]interface{}{
+		"policy":    policyReportSource,
+		"rule":      ruleID,
+		"result":    result,
+		"scored":    true,
+		"source":    policyReportSource,
+		"message":   message,
+		"resources": []interface{}{resource},
+		"timestamp": map[string]interface{}{
+			"seconds": res.timestamp.Unix(),
+			"nanos":   int64(res.timestamp.Nanosecond()),
+		},
+	}
+	if len(properties) > 0 {
+		entry["properties"] = properties
+	}
+	return result, entry
+}
+
+func resourceKey(kind metav1.GroupVersionKind, name string) string {
+	return kind.Group + "/" + kind.Kind + "/" + name
+}
@@ -0,0 +1,154 @@
+// Package redact hides secrets before they are rendered in violations or
+// written to the logs. Raw object content and finding quotes must always go
+// through this package.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Modes of a Censor
+const (
+	// ModePartial keeps a few characters at both ends of the secret
+	ModePartial = "partial"
+	// ModeMask hides the whole secret
+	ModeMask = "mask"
+	// ModeHash shows a fingerprint of the secret instead
+	ModeHash = "hash"
+)
+
+const (
+	// DefaultKeep is the number of characters kept at each end by ModePartial
+	DefaultKeep = 2
+	// masked replaces the hidden characters, whatever their number, so that
+	// the length of the secret is not revealed
+	masked = "**"
+	// fingerprintLength is the number of hex characters of a fingerprint
+	fingerprintLength = 12
+	// MinKeyLength is the least number of bytes of the hash key
+	MinKeyLength = 16
+)
+
+// key is the HMAC key of the hashes and fingerprints, so that short secrets
+// cannot be found back from them by brute force
+var key atomic.Value
+
+func init() {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		panic(err)
+	}
+	key.Store(k)
+}
+
+// SetKey sets the key of the hashes and fingerprints. Until it is called a
+// random key is used, so hashes change every time the process starts and
+// cannot be used to allow findings.
+func SetKey(k []byte) error {
+	if len(k) < MinKeyLength {
+		return fmt.Errorf("hash key must be at least %d bytes", MinKeyLength)
+	}
+	key.Store(append([]byte(nil), k...))
+	return nil
+}
+
+// Hash is the hex encoded HMAC-SHA256 of the secret, which identifies a
+// finding, e.g. to allow it
+func Hash(secret string) string {
+	mac := hmac.New(sha256.New, key.Load().([]byte))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Censor renders the secrets found in an object. The zero value keeps two
+// characters at each end, e.g. `hu**et`.
+type Censor struct {
+	// Mode is partial (the default), mask or hash
+	Mode string `json:"mode,omitempty"`
+	// Keep is the number of characters kept at each end in partial mode
+	Keep int `json:"keep,omitempty"`
+}
+
+// Merge returns a copy of c where the fields set in o win
+func (c Censor) Merge(o Censor) Censor {
+	merged := c
+	if o.Mode != "" {
+		merged.Mode = o.Mode
+	}
+	if o.Keep != 0 {
+		merged.Keep = o.Keep
+	}
+	return merged
+}
+
+// Validate returns all the problems found in the censor. Each error message
+// starts with the name of the offending field.
+func (c Censor) Validate() []error {
+	var errs []error
+	switch c.Mode {
+	case "", ModePartial, ModeMask, ModeHash:
+	default:
+		errs = append(errs, fmt.Errorf("mode: must be one of %s, %s or %s", ModePartial, ModeMask, ModeHash))
+	}
+	if c.Keep < 0 {
+		errs = append(errs, fmt.Errorf("keep: must not be negative"))
+	}
+	return errs
+}
+
+// Apply censors the secret. Partial mode never shows more than a quarter of
+// the secret at each end, so short secrets keep fewer characters.
+func (c Censor) Apply(secret string) string {
+	switch c.Mode {
+	case ModeMask:
+		return masked
+	case ModeHash:
+		return Fingerprint(secret)
+	}
+
+	keep := c.Keep
+	if keep == 0 {
+		keep = DefaultKeep
+	}
+	runes := []rune(secret)
+	if max := len(runes) / 4; keep > max {
+		keep = max
+	}
+	if keep == 0 {
+		return masked
+	}
+	return string(runes[:keep]) + masked + string(runes[len(runes)-keep:])
+}
+
+// Hash returns the hash shown next to a censored secret, so that the finding
+// can be allowed. There is none in mask mode, which shows nothing of the
+// secret, nor in hash mode, which already shows its fingerprint.
+func (c Censor) Hash(secret string) string {
+	if c.Mode == ModeMask || c.Mode == ModeHash {
+		return ""
+	}
+	return Hash(secret)
+}
+
+// Fingerprint identifies a secret without revealing it, e.g. in the logs
+func Fingerprint(secret string) string {
+	return "hmac:" + Hash(secret)[:fingerprintLength]
+}
+
+// Bytes describes raw content, such as an object which could not be decoded,
+// by its size and fingerprint only
+func Bytes(b []byte) string {
+	return fmt.Sprintf("<redacted %d bytes %s>", len(b), Fingerprint(string(b)))
+}
+
+// Text describes text which is sent to a detector by its size, number of
+// lines and fingerprint only
+func Text(s string) string {
+	return fmt.Sprintf("<redacted %d bytes in %d lines %s>", len(s), strings.Count(s, "\n"), Fingerprint(s))
+}
@@ -0,0 +1,123 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/imrenagi/satpol-pp/server/policy"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes one test case per object, named after the object and its
+// document index, grouped in a test suite per file. Denied objects fail,
+// objects which could not be checked are errors, and warned or audited
+// violations are written to the output of the test.
+func writeJUnit(w io.Writer, results []Result) error {
+	report := junitTestSuites{}
+	suites := make(map[string]int)
+	for _, r := range results {
+		i, ok := suites[r.Source]
+		if !ok {
+			i = len(report.Suites)
+			suites[r.Source] = i
+			report.Suites = append(report.Suites, junitTestSuite{Name: r.Source})
+		}
+		suite := &report.Suites[i]
+
+		tc := junitTestCase{
+			Name:      fmt.Sprintf("%s/%s (document %d)", r.Kind, r.Name, r.Index),
+			ClassName: r.Source,
+		}
+		var out []string
+		for _, v := range r.Violations {
+			if v.Action != policy.ActionEnforce {
+				out = append(out, fmt.Sprintf("%s: %s", v.Action, describe(r.Source, v)))
+			}
+		}
+		tc.SystemOut = strings.Join(out, "\n")
+
+		switch {
+		case r.Allowed:
+		case r.Denied():
+			var lines []string
+			for _, v := range r.Violations {
+				if v.Action == policy.ActionEnforce {
+					lines = append(lines, describe(r.Source, v))
+				}
+			}
+			tc.Failure = &junitProblem{Message: firstLine(r.Message), Type: "policy", Text: strings.Join(lines, "\n")}
+			suite.Failures++
+			report.Failures++
+		default:
+			tc.Error = &junitProblem{Message: firstLine(r.Message), Type: "error", Text: r.Message}
+			suite.Errors++
+			report.Errors++
+		}
+
+		suite.TestCases = append(suite.TestCases, tc)
+		suite.Tests++
+		report.Tests++
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// describe formats a violation as `file:line: [rule] message (field)`
+func describe(source string, v Violation) string {
+	loc := source
+	if v.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", source, v.Line)
+	}
+	s := fmt.Sprintf("%s: [%s] %s", loc, v.RuleID, v.Message)
+	if v.Field != "" {
+		s += fmt.Sprintf(" (%s)", v.Field)
+	}
+	return s
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+// Package report writes the results of checking manifests in the formats read
+// by CI systems
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/imrenagi/satpol-pp/server/policy"
+)
+
+// Output formats
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatSARIF = "sarif"
+	FormatJUnit = "junit"
+)
+
+// Formats lists every supported output format
+var Formats = []string{FormatText, FormatJSON, FormatSARIF, FormatJUnit}
+
+// Violation is a violated rule of an object
+type Violation struct {
+	RuleID string `json:"ruleID"`
+	// Action is the enforcement action of the rule: enforce, warn or audit
+	Action  policy.Action `json:"action"`
+	Field   string        `json:"field,omitempty"`
+	Message string        `json:"message"`
+	// Line is the line of the field in the manifest, or 0 when unknown
+	Line int `json:"line,omitempty"`
+}
+
+// Result is the outcome of checking one object
+type Result struct {
+	Source string `json:"source"`
+	// Index is the position of the document in the source
+	Index      int    `json:"index"`
+	Line       int    `json:"line,omitempty"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	Allowed    bool   `json:"allowed"`
+	// Message is the message of the webhook when the object is denied
+	Message    string      `json:"message,omitempty"`
+	Warnings   []string    `json:"warnings,omitempty"`
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Denied reports whether the object was denied because of its violations,
+// rather than because it could not be checked
+func (r Result) Denied() bool {
+	for _, v := range r.Violations {
+		if v.Action == policy.ActionEnforce {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the results in the given format
+func Write(w io.Writer, format string, results []Result) error {
+	switch format {
+	case "", FormatText:
+		return writeText(w, results)
+	case FormatJSON:
+		return writeJSON(w, results)
+	case FormatSARIF:
+		return writeSARIF(w, results)
+	case FormatJUnit:
+		return writeJUnit(w, results)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// writeText prints the results the way kubectl shows the webhook responses
+func writeText(w io.Writer, results []Result) error {
+	for _, r := range results {
+		ref := fmt.Sprintf("%s: %s/%s", r.Source, r.Kind, r.Name)
+		for _, warning := range r.Warnings {
+			if _, err := fmt.Fprintf(w, "%s: Warning: %s\n", ref, warning); err != nil {
+				return err
+			}
+		}
+		if r.Allowed {
+			continue
+		}
+
+		msg := "denied the request"
+		if r.Message != "" {
+			msg += ": " + r.Message
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", ref, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, results []Result) error {
+	if results == nil {
+		results = []Result{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Results []Result `json:"results"`
+	}{results})
+}
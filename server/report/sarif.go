@@ -0,0 +1,176 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	vs "github.com/imrenagi/satpol-pp/version"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	toolName     = "satpol-pp"
+	toolURI      = "https://github.com/imrenagi/satpol-pp"
+)
+
+// levels maps the enforcement actions to SARIF levels
+var levels = map[policy.Action]string{
+	policy.ActionEnforce: "error",
+	policy.ActionWarn:    "warning",
+	policy.ActionAudit:   "note",
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifResult struct {
+	RuleID     string          `json:"ruleId"`
+	Level      string          `json:"level"`
+	Message    sarifMessage    `json:"message"`
+	Locations  []sarifLocation `json:"locations"`
+	Properties sarifProperties `json:"properties"`
+}
+
+// sarifProperties tell apart objects of the same kind and name in one file
+type sarifProperties struct {
+	DocumentIndex int `json:"documentIndex"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeSARIF writes the violations as a SARIF 2.1.0 log, e.g. for GitHub code
+// scanning. Objects which could not be checked are reported as notifications.
+func writeSARIF(w io.Writer, results []Result) error {
+	rules := make([]sarifRule, 0, len(agent.Rules))
+	for _, id := range agent.Rules {
+		rules = append(rules, sarifRule{
+			ID:               id,
+			ShortDescription: sarifMessage{Text: agent.RuleDescriptions[id]},
+		})
+	}
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           toolName,
+			Version:        vs.GetVersion().Version,
+			InformationURI: toolURI,
+			Rules:          rules,
+		}},
+		Invocations: []sarifInvocation{{ExecutionSuccessful: true}},
+		Results:     []sarifResult{},
+	}
+
+	for _, r := range results {
+		if !r.Allowed && !r.Denied() {
+			run.Invocations[0].ToolExecutionNotifications = append(run.Invocations[0].ToolExecutionNotifications, sarifNotification{
+				Level:     "error",
+				Message:   sarifMessage{Text: r.Kind + "/" + r.Name + ": " + r.Message},
+				Locations: []sarifLocation{location(r, r.Line)},
+			})
+		}
+		for _, v := range r.Violations {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:     v.RuleID,
+				Level:      levels[v.Action],
+				Message:    sarifMessage{Text: r.Kind + "/" + r.Name + ": " + v.Message},
+				Locations:  []sarifLocation{location(r, v.Line)},
+				Properties: sarifProperties{DocumentIndex: r.Index},
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs:    []sarifRun{run},
+	})
+}
+
+// location points at the line in the file of the result, and at the object by
+// its document index, e.g. `documents[1]/Deployment/web`
+func location(r Result, line int) sarifLocation {
+	loc := sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(r.Source)},
+		},
+		LogicalLocations: []sarifLogicalLocation{{
+			Name:               r.Name,
+			FullyQualifiedName: fmt.Sprintf("documents[%d]/%s/%s", r.Index, r.Kind, r.Name),
+			Kind:               "resource",
+		}},
+	}
+	if line > 0 {
+		loc.PhysicalLocation.Region = &sarifRegion{StartLine: line}
+	}
+	return loc
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+
+	dep "github.com/imrenagi/satpol-pp/server/agent/deployment"
+	"github.com/imrenagi/satpol-pp/server/metrics"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// ReviewFunc is called with every admission request, its response and how the
+// object was evaluated. The evaluation is nil when the object was skipped or
+// could not be checked.
+type ReviewFunc func(req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *Evaluation)
+
+// OnReview registers fn to be called after each admission request served by
+// the handler. It must be called before the handler serves requests.
+func (h *Handler) OnReview(fn ReviewFunc) {
+	h.onReview = append(h.onReview, fn)
+}
+
+// reviewed notifies the review functions. Dry run requests do not persist
+// anything, so they are not reported.
+func (h *Handler) reviewed(req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *Evaluation) {
+	if req.DryRun != nil && *req.DryRun {
+		return
+	}
+	for _, fn := range h.onReview {
+		fn(req, resp, eval)
+	}
+}
+
+// Review checks the request with the same checks as the webhook path serving
+// its kind, and returns the response with how the object was evaluated.
+// Requests of kinds without a check are allowed without evaluation.
+func (h *Handler) Review(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, *Evaluation) {
+	var (
+		resp *admissionv1.AdmissionResponse
+		eval *Evaluation
+	)
+	switch kind := req.Kind.Kind; kind {
+	case "ConfigMap":
+		resp, eval = h.checkConfigMap(ctx, req)
+	case dep.KindEphemeralContainers:
+		resp, eval = h.checkWorkload(ctx, dep.KindPod, req)
+	default:
+		if !isWorkloadKind(kind) {
+			return &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}, nil
+		}
+		resp, eval = h.checkWorkload(ctx, kind, req)
+	}
+	resp.UID = req.UID
+	return resp, eval
+}
+
+func isWorkloadKind(kind string) bool {
+	for _, k := range dep.WorkloadKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// observe counts the admission request and its violations
+func observe(path string, req *admissionv1.AdmissionRequest, resp *admissionv1.AdmissionResponse, eval *Evaluation) {
+	decision := metrics.DecisionAllowed
+	switch {
+	case !resp.Allowed && (eval == nil || len(eval.Decisions) == 0):
+		decision = metrics.DecisionError
+	case !resp.Allowed:
+		decision = metrics.DecisionDenied
+	case len(resp.Warnings) > 0:
+		decision = metrics.DecisionWarned
+	}
+	metrics.AdmissionRequests.WithLabelValues(path, req.Kind.Kind, req.Namespace, decision).Inc()
+
+	if eval == nil {
+		return
+	}
+	for _, d := range eval.Decisions {
+		metrics.Violations.WithLabelValues(path, req.Kind.Kind, req.Namespace, d.RuleID, string(d.Action)).Inc()
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/metrics"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Decision is a violation together with the action taken for it
+type Decision struct {
+	agent.Violation
+	Action policy.Action
+}
+
+// Evaluation is how an object was checked against the policy
+type Evaluation struct {
+	// Rules are the ids of the rules the object was checked against
+	Rules []string
+	// Decisions are the violations found and the action taken for each
+	Decisions []Decision
+}
+
+// Action returns the strictest action taken for the violations of the rule,
+// or an empty action when the rule is not violated
+func (e *Evaluation) Action(ruleID string) policy.Action {
+	var action policy.Action
+	for _, d := range e.Decisions {
+		if d.RuleID != ruleID {
+			continue
+		}
+		if d.Action == policy.ActionEnforce || action == "" || (d.Action == policy.ActionWarn && action == policy.ActionAudit) {
+			action = d.Action
+		}
+	}
+	return action
+}
+
+// enforce applies the action of each violated rule. Enforced violations deny
+// the request, warned ones are returned as warnings, and audited ones are only
+// logged.
+func (h *Handler) enforce(resp *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, name string, p *policy.Policy, violations agent.Violations) []Decision {
+	var denied agent.Violations
+	decisions := make([]Decision, 0, len(violations))
+	for _, v := range violations {
+		action := p.Enforcement.ActionFor(v.RuleID)
+		decisions = append(decisions, Decision{Violation: v, Action: action})
+		switch action {
+		case policy.ActionAudit:
+			h.Log.Info().
+				EmbedObject(v).
+				Str("kind", req.Kind.Kind).
+				Str("namespace", req.Namespace).
+				Str("name", name).
+				Msg("audited policy violation")
+		case policy.ActionWarn:
+			resp.Warnings = append(resp.Warnings, v.String())
+		default:
+			denied = append(denied, v)
+		}
+	}
+
+	if len(denied) > 0 {
+		deny(resp, req, name, denied)
+	}
+	return decisions
+}
+
+// deny rejects the request with all the violations found in the object. Each
+// violation is listed in the message and as a cause of the status, so that
+// `kubectl apply` shows everything which has to be fixed at once.
+func deny(resp *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, name string, violations agent.Violations) {
+	causes := make([]metav1.StatusCause, 0, len(violations))
+	for _, v := range violations {
+		causes = append(causes, metav1.StatusCause{
+			Type:    metav1.CauseType(v.RuleID),
+			Message: v.Message,
+			Field:   v.Field,
+		})
+	}
+
+	resp.Allowed = false
+	resp.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  metav1.StatusReasonForbidden,
+		Message: fmt.Sprintf("%d policy violation(s) found:\n%s", len(violations), violations.Error()),
+		Details: &metav1.StatusDetails{
+			Name:   name,
+			Group:  req.Kind.Group,
+			Kind:   req.Kind.Kind,
+			Causes: causes,
+		},
+	}
+}
+
+// checkFailed answers a request whose rule could not be checked with the
+// onError action of the rule. Allowing or warning fails open, so it is always
+// logged and counted.
+func (h *Handler) checkFailed(resp *admissionv1.AdmissionResponse, req *admissionv1.AdmissionRequest, name string, p *policy.Policy, ruleID string, err error) *admissionv1.AdmissionResponse {
+	action := p.Enforcement.OnErrorFor(ruleID)
+	metrics.CheckErrors.WithLabelValues(ruleID, string(action)).Inc()
+
+	switch action {
+	case policy.ErrorAllow, policy.ErrorWarn:
+		h.Log.Warn().
+			Err(err).
+			Str("rule", ruleID).
+			Str("on_error", string(action)).
+			Str("kind", req.Kind.Kind).
+			Str("namespace", req.Namespace).
+			Str("name", name).
+			Msg("check failed, request is allowed (fail open)")
+		if action == policy.ErrorWarn {
+			resp.Warnings = append(resp.Warnings, fmt.Sprintf("[%s] could not be checked, request is allowed: %s", ruleID, err))
+		}
+		return resp
+	default:
+		h.Log.Error().
+			Err(err).
+			Str("rule", ruleID).
+			Str("kind", req.Kind.Kind).
+			Str("namespace", req.Namespace).
+			Str("name", name).
+			Msg("check failed, request is denied")
+		return admissionError(fmt.Errorf("[%s] could not be checked: %w", ruleID, err))
+	}
+}
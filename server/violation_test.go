@@ -0,0 +1,163 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/imrenagi/satpol-pp/server/agent"
+	"github.com/imrenagi/satpol-pp/server/policy"
+	"github.com/rs/zerolog"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnforce(t *testing.T) {
+	registry := agent.Violation{RuleID: agent.RuleRegistry, Message: "image is not allowed"}
+	probe := agent.Violation{RuleID: agent.RuleProbe, Message: "liveness probe is missing"}
+
+	tests := []struct {
+		name         string
+		enforcement  policy.Enforcement
+		violations   agent.Violations
+		wantAllowed  bool
+		wantWarnings []string
+		wantCauses   int
+		wantActions  []policy.Action
+	}{
+		{
+			name:        "no violations",
+			wantAllowed: true,
+			wantActions: []policy.Action{},
+		},
+		{
+			name:        "enforce by default",
+			violations:  agent.Violations{registry, probe},
+			wantCauses:  2,
+			wantActions: []policy.Action{policy.ActionEnforce, policy.ActionEnforce},
+		},
+		{
+			name:         "warn",
+			enforcement:  policy.Enforcement{Default: policy.ActionWarn},
+			violations:   agent.Violations{registry, probe},
+			wantAllowed:  true,
+			wantWarnings: []string{registry.String(), probe.String()},
+			wantActions:  []policy.Action{policy.ActionWarn, policy.ActionWarn},
+		},
+		{
+			name:        "audit",
+			enforcement: policy.Enforcement{Default: policy.ActionAudit},
+			violations:  agent.Violations{registry, probe},
+			wantAllowed: true,
+			wantActions: []policy.Action{policy.ActionAudit, policy.ActionAudit},
+		},
+		{
+			name:         "enforce and warn",
+			enforcement:  policy.Enforcement{Rules: map[string]policy.Action{agent.RuleProbe: policy.ActionWarn}},
+			violations:   agent.Violations{registry, probe},
+			wantWarnings: []string{probe.String()},
+			wantCauses:   1,
+			wantActions:  []policy.Action{policy.ActionEnforce, policy.ActionWarn},
+		},
+		{
+			name:         "warn and audit",
+			enforcement:  policy.Enforcement{Default: policy.ActionAudit, Rules: map[string]policy.Action{agent.RuleRegistry: policy.ActionWarn}},
+			violations:   agent.Violations{registry, probe},
+			wantAllowed:  true,
+			wantWarnings: []string{registry.String()},
+			wantActions:  []policy.Action{policy.ActionWarn, policy.ActionAudit},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Log: zerolog.Nop()}
+			req := &admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+				Namespace: "default",
+			}
+			resp := &admissionv1.AdmissionResponse{Allowed: true}
+			decisions := h.enforce(resp, req, "app", &policy.Policy{Enforcement: tt.enforcement}, tt.violations)
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if !reflect.DeepEqual(resp.Warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", resp.Warnings, tt.wantWarnings)
+			}
+			var causes int
+			if resp.Result != nil {
+				causes = len(resp.Result.Details.Causes)
+			}
+			if causes != tt.wantCauses {
+				t.Errorf("got %d causes, want %d", causes, tt.wantCauses)
+			}
+			actions := make([]policy.Action, 0, len(decisions))
+			for _, d := range decisions {
+				actions = append(actions, d.Action)
+			}
+			if !reflect.DeepEqual(actions, tt.wantActions) {
+				t.Errorf("got actions %v, want %v", actions, tt.wantActions)
+			}
+		})
+	}
+}
+
+func TestCheckFailed(t *testing.T) {
+	errDLP := errors.New("dlp is unavailable")
+
+	tests := []struct {
+		name         string
+		onError      map[string]policy.ErrorAction
+		rule         string
+		wantAllowed  bool
+		wantWarnings int
+	}{
+		{name: "deny by default", rule: agent.RuleConfigMapSecret},
+		{name: "workload secret warns by default", rule: agent.RuleWorkloadSecret, wantAllowed: true, wantWarnings: 1},
+		{
+			name:    "deny",
+			onError: map[string]policy.ErrorAction{agent.RuleWorkloadSecret: policy.ErrorDeny},
+			rule:    agent.RuleWorkloadSecret,
+		},
+		{
+			name:        "allow",
+			onError:     map[string]policy.ErrorAction{agent.RuleConfigMapSecret: policy.ErrorAllow},
+			rule:        agent.RuleConfigMapSecret,
+			wantAllowed: true,
+		},
+		{
+			name:         "warn",
+			onError:      map[string]policy.ErrorAction{agent.RuleConfigMapSecret: policy.ErrorWarn},
+			rule:         agent.RuleConfigMapSecret,
+			wantAllowed:  true,
+			wantWarnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Log: zerolog.Nop()}
+			req := &admissionv1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+				Namespace: "default",
+			}
+			p := &policy.Policy{Enforcement: policy.Enforcement{OnError: tt.onError}}
+			resp := h.checkFailed(&admissionv1.AdmissionResponse{Allowed: true}, req, "app", p, tt.rule, errDLP)
+
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("got allowed %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if len(resp.Warnings) != tt.wantWarnings {
+				t.Errorf("got warnings %q, want %d", resp.Warnings, tt.wantWarnings)
+			}
+			for _, w := range resp.Warnings {
+				if !strings.HasPrefix(w, "["+tt.rule+"]") || !strings.Contains(w, errDLP.Error()) {
+					t.Errorf("warning %q does not name the rule and the error", w)
+				}
+			}
+			if !tt.wantAllowed && (resp.Result == nil || !strings.Contains(resp.Result.Message, errDLP.Error())) {
+				t.Errorf("got result %v, want the error", resp.Result)
+			}
+		})
+	}
+}